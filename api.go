@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+	"github.com/skilld-labs/telemetry-opcua-exporter/web"
+)
+
+const metricsAPIPath = "/api/v1/metrics"
+
+// metricsAPI exposes the metrics of the config as REST resources. Changes
+// are written to the file declaring the metric, keeping its comments, and
+// applied through a reload.
+type metricsAPI struct {
+	logger     log.Logger
+	configPath string
+	history    *config.History
+}
+
+type metricResource struct {
+	ID string `json:"id"`
+	// File declares the metric, Templated tells it is expanded from a
+	// template and cannot be changed through the API.
+	File      string `json:"file,omitempty"`
+	Templated bool   `json:"templated,omitempty"`
+	config.Metric
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newMetricsAPI(logger log.Logger, configPath string, history *config.History) *metricsAPI {
+	return &metricsAPI{logger: logger, configPath: configPath, history: history}
+}
+
+func (a *metricsAPI) register(mux *http.ServeMux, auth *web.Authenticator) {
+	mux.Handle(metricsAPIPath, auth.ProtectWrites(http.HandlerFunc(a.collection)))
+	mux.Handle(metricsAPIPath+"/", auth.ProtectWrites(http.HandlerFunc(a.item)))
+}
+
+func (a *metricsAPI) collection(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	entries, etag, err := a.read()
+	if err != nil {
+		a.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rr := []metricResource{}
+		for _, e := range entries {
+			rr = append(rr, newMetricResource(e))
+		}
+		w.Header().Set("ETag", etag)
+		a.json(w, http.StatusOK, rr)
+	case "POST":
+		if v := r.Header.Get("If-Match"); v != "" && v != "*" && v != etag {
+			a.error(w, http.StatusPreconditionFailed, fmt.Errorf("metrics were modified, current ETag is %s", etag))
+			return
+		}
+		m, status, err := decodeMetric(r)
+		if err != nil {
+			a.error(w, status, err)
+			return
+		}
+		if i := findMetric(entries, m.ID()); i >= 0 {
+			a.error(w, http.StatusConflict, fmt.Errorf("metric %s already exists with id %s", m.Name, m.ID()))
+			return
+		}
+		// new metrics go to the config file, a directory has none
+		if err := checkConfigFile(a.configPath); err != nil {
+			a.error(w, updateStatus(err), err)
+			return
+		}
+		e := config.MetricEntry{Metric: m, File: a.configPath, Index: -1}
+		if !a.write(w, r, e, &m) {
+			return
+		}
+		w.Header().Set("Location", metricsAPIPath+"/"+m.ID())
+		w.Header().Set("ETag", metricETag(m))
+		a.json(w, http.StatusCreated, metricResource{ID: m.ID(), File: e.File, Metric: m})
+	default:
+		http.Error(w, "GET or POST method expected", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *metricsAPI) item(w http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	id := strings.TrimPrefix(r.URL.Path, metricsAPIPath+"/")
+	entries, _, err := a.read()
+	if err != nil {
+		a.error(w, http.StatusInternalServerError, err)
+		return
+	}
+	i := findMetric(entries, id)
+	if i < 0 {
+		a.error(w, http.StatusNotFound, fmt.Errorf("unknown metric %s", id))
+		return
+	}
+	e := entries[i]
+	etag := metricETag(e.Metric)
+	if r.Method == "GET" {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		a.json(w, http.StatusOK, newMetricResource(e))
+		return
+	}
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		http.Error(w, "GET, PUT or DELETE method expected", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch v := r.Header.Get("If-Match"); {
+	case v == "":
+		a.error(w, http.StatusPreconditionRequired, fmt.Errorf("missing If-Match header, current ETag is %s", etag))
+		return
+	case v != "*" && v != etag:
+		a.error(w, http.StatusPreconditionFailed, fmt.Errorf("metric %s was modified, current ETag is %s", id, etag))
+		return
+	}
+	if e.Index < 0 {
+		a.error(w, http.StatusConflict, fmt.Errorf("metric %s is expanded from a template of %s, change the template instead", id, e.File))
+		return
+	}
+	if r.Method == "DELETE" {
+		if !a.write(w, r, e, nil) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	m, status, err := decodeMetric(r)
+	if err != nil {
+		a.error(w, status, err)
+		return
+	}
+	if j := findMetric(entries, m.ID()); j >= 0 && j != i {
+		a.error(w, http.StatusConflict, fmt.Errorf("metric %s already exists with id %s", m.Name, m.ID()))
+		return
+	}
+	if !a.write(w, r, e, &m) {
+		return
+	}
+	if m.ID() != id {
+		w.Header().Set("Location", metricsAPIPath+"/"+m.ID())
+	}
+	e.Metric = m
+	w.Header().Set("ETag", metricETag(m))
+	a.json(w, http.StatusOK, newMetricResource(e))
+}
+
+// read loads the config files, returning their metrics with an ETag
+// changing along with their content.
+func (a *metricsAPI) read() ([]config.MetricEntry, string, error) {
+	if _, err := os.Stat(a.configPath); os.IsNotExist(err) {
+		return nil, etagOf(nil), nil
+	}
+	mm, err := config.ReadMetricsConfig(a.configPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return mm.Entries(), etagOf([]byte(mm.Fingerprint())), nil
+}
+
+// write replaces the metric e in its file by m, removing it when m is nil,
+// and applies the result. It answers with an error and returns false when
+// the change could not be applied.
+func (a *metricsAPI) write(w http.ResponseWriter, r *http.Request, e config.MetricEntry, m *config.Metric) bool {
+	content, err := ioutil.ReadFile(e.File)
+	if err != nil && !os.IsNotExist(err) {
+		a.error(w, http.StatusInternalServerError, err)
+		return false
+	}
+	content, err = config.EditMetric(content, e.Index, m)
+	if err != nil {
+		a.error(w, http.StatusInternalServerError, fmt.Errorf("cannot edit %s: %v", e.File, err))
+		return false
+	}
+	if err := updateConfig(a.logger, e.File, content); err != nil {
+		a.error(w, updateStatus(err), err)
+		return false
+	}
+	// the history tracks the config file, not the files it includes
+	if e.File != a.configPath {
+		return true
+	}
+	if _, err := a.history.Add(content, clientAddress(r), 0); err != nil {
+		a.logger.Err("error recording config revision: %v", err)
+	}
+	return true
+}
+
+func (a *metricsAPI) json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		a.logger.Err("error encoding response: %v", err)
+	}
+}
+
+func (a *metricsAPI) error(w http.ResponseWriter, status int, err error) {
+	a.json(w, status, apiError{Error: err.Error()})
+}
+
+func newMetricResource(e config.MetricEntry) metricResource {
+	return metricResource{ID: e.ID(), File: e.File, Templated: e.Index < 0, Metric: e.Metric}
+}
+
+// decodeMetric reads the JSON metric sent in the body of r, it returns the
+// HTTP status to answer with when it cannot.
+func decodeMetric(r *http.Request) (config.Metric, int, error) {
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+		return config.Metric{}, http.StatusUnsupportedMediaType, fmt.Errorf("expected Content-Type application/json")
+	}
+	// the fields of a fetched resource are accepted so that it can be sent back as is
+	var m metricResource
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return m.Metric, http.StatusBadRequest, fmt.Errorf("invalid metric: %v", err)
+	}
+	return m.Metric, 0, nil
+}
+
+func findMetric(entries []config.MetricEntry, id string) int {
+	for i, e := range entries {
+		if e.ID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func metricETag(m config.Metric) string {
+	content, _ := json.Marshal(m)
+	return etagOf(content)
+}
+
+func etagOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+)
+
+const temperatureJSON = `{"name": "temperature", "help": "temperature", "nodeid": "ns=2;i=1", "type": "gauge"}`
+
+// apiRequest sends a request to the metrics API of the config at path and
+// returns the recorded response.
+func apiRequest(t *testing.T, a *metricsAPI, method, url, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsAPIPath, a.collection)
+	mux.HandleFunc(metricsAPIPath+"/", a.item)
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, url, r)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func newTestAPI(t *testing.T, content string) (*metricsAPI, string) {
+	t.Helper()
+	path := newConfigFile(t, content)
+	fakeReloads(t, path)
+	history, err := config.OpenHistory("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMetricsAPI(nopLogger{}, path, history), path
+}
+
+func apiErrorOf(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var e apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("invalid error body %q: %v", w.Body, err)
+	}
+	return e.Error
+}
+
+func TestMetricsAPICreate(t *testing.T) {
+	a, path := newTestAPI(t, "metrics: []\n")
+	id := config.Metric{Name: "temperature"}.ID()
+
+	tests := []struct {
+		name    string
+		body    string
+		header  map[string]string
+		status  int
+		err     string
+		created bool
+	}{
+		{name: "unsupported media type", body: temperatureJSON, header: map[string]string{"Content-Type": "text/yaml"}, status: http.StatusUnsupportedMediaType, err: "expected Content-Type application/json"},
+		{name: "unknown field", body: `{"name": "temperature", "unit": "celsius"}`, status: http.StatusBadRequest, err: `unknown field "unit"`},
+		{name: "stale If-Match", body: temperatureJSON, header: map[string]string{"If-Match": `"0"`}, status: http.StatusPreconditionFailed, err: "metrics were modified"},
+		{name: "rejected metric", body: `{"name": "temperature", "help": "temperature", "type": "gauge"}`, status: http.StatusUnprocessableEntity, err: "missing field 'nodeid'"},
+		{name: "created", body: temperatureJSON, status: http.StatusCreated, created: true},
+		{name: "already exists", body: temperatureJSON, status: http.StatusConflict, err: "already exists with id " + id, created: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := apiRequest(t, a, "POST", metricsAPIPath, tt.body, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d (%s), want %d", w.Code, w.Body, tt.status)
+			}
+			if tt.err != "" {
+				if got := apiErrorOf(t, w); !strings.Contains(got, tt.err) {
+					t.Errorf("got error %q, want %q", got, tt.err)
+				}
+			} else if got := w.Header().Get("Location"); got != metricsAPIPath+"/"+id {
+				t.Errorf("got Location %q", got)
+			}
+			if got := strings.Contains(readFile(t, path), "ns=2;i=1"); got != tt.created {
+				t.Errorf("metric in the config file: %v, want %v", got, tt.created)
+			}
+		})
+	}
+}
+
+func TestMetricsAPIConditionalRequests(t *testing.T) {
+	a, path := newTestAPI(t, `
+metrics:
+  # the temperature of the oven
+  - name: temperature
+    help: temperature
+    nodeid: ns=2;i=1
+    type: gauge
+`)
+	url := metricsAPIPath + "/" + config.Metric{Name: "temperature"}.ID()
+
+	w := apiRequest(t, a, "GET", metricsAPIPath, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d (%s)", w.Code, w.Body)
+	}
+	if w := apiRequest(t, a, "GET", metricsAPIPath, "", map[string]string{"If-None-Match": w.Header().Get("ETag")}); w.Code != http.StatusNotModified {
+		t.Errorf("got status %d for the collection, want %d", w.Code, http.StatusNotModified)
+	}
+	w = apiRequest(t, a, "GET", url, "", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d with ETag %q", w.Code, etag)
+	}
+
+	updated := strings.Replace(temperatureJSON, `"help": "temperature"`, `"help": "oven temperature"`, 1)
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		status int
+		err    string
+	}{
+		{name: "missing If-Match", method: "PUT", status: http.StatusPreconditionRequired, err: "missing If-Match header, current ETag is " + etag},
+		{name: "stale If-Match", method: "PUT", header: map[string]string{"If-Match": `"0"`}, status: http.StatusPreconditionFailed, err: "was modified, current ETag is " + etag},
+		{name: "delete with stale If-Match", method: "DELETE", header: map[string]string{"If-Match": `"0"`}, status: http.StatusPreconditionFailed},
+		{name: "unknown field", method: "PUT", header: map[string]string{"If-Match": etag}, status: http.StatusBadRequest, err: "unknown field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := updated
+			if tt.err == "unknown field" {
+				body = `{"name": "temperature", "unit": "celsius"}`
+			}
+			w := apiRequest(t, a, tt.method, url, body, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d (%s), want %d", w.Code, w.Body, tt.status)
+			}
+			if got := apiErrorOf(t, w); !strings.Contains(got, tt.err) {
+				t.Errorf("got error %q, want %q", got, tt.err)
+			}
+			if strings.Contains(readFile(t, path), "oven temperature") {
+				t.Error("the config file was changed")
+			}
+		})
+	}
+
+	w = apiRequest(t, a, "PUT", url, updated, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d (%s) for the update", w.Code, w.Body)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("the ETag did not change with the metric")
+	}
+	content := readFile(t, path)
+	if !strings.Contains(content, "help: oven temperature") || !strings.Contains(content, "# the temperature of the oven") {
+		t.Errorf("got config file\n%s", content)
+	}
+	// the ETag read before the update is now stale
+	if w := apiRequest(t, a, "DELETE", url, "", map[string]string{"If-Match": etag}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("got status %d for a delete with a stale ETag, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if w := apiRequest(t, a, "DELETE", url, "", map[string]string{"If-Match": "*"}); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d (%s) for the delete", w.Code, w.Body)
+	}
+	if w := apiRequest(t, a, "GET", url, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d after the delete, want %d", w.Code, http.StatusNotFound)
+	}
+}
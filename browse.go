@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/skilld-labs/telemetry-opcua-exporter/collector"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+func browseHandler(logger log.Logger, metricsCollector *collector.Collector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := query(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(apiError{Error: err.Error()})
+			return
+		}
+		if nodeID := q.Get("node"); nodeID != "" {
+			if _, err := ua.ParseNodeID(nodeID); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(apiError{Error: fmt.Sprintf("invalid node id %q: %v", nodeID, err)})
+				return
+			}
+		}
+		node, err := metricsCollector.Browse(q.Get("node"))
+		if err != nil {
+			logger.Warn("error browsing %s: %v", q.Get("node"), err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(apiError{Error: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(node)
+	}
+}
+
+// query returns the parameters of r. A node id with an unescaped ";" is
+// rejected, url.Values dropping the parameter would select the default node.
+func query(r *http.Request) (url.Values, error) {
+	q, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query, escape the ; of node ids as %%3B: %v", err)
+	}
+	return q, nil
+}
+
+func browseUIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(browsePage))
+}
+
+// browsePage walks the address space through /browse and adds the selected
+// variable through the metrics API.
+const browsePage = `<!DOCTYPE html>
+<html>
+<head>
+<title>OPC UA Exporter - Browse</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 2px 8px; vertical-align: top; }
+#children a { cursor: pointer; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1><a href="/">OPC UA Exporter</a> - Browse</h1>
+<form id="goto"><input id="nodeid" size="40" placeholder="ns=0;i=85"> <button>Browse</button> <button type="button" id="up">Back</button></form>
+<p id="message"></p>
+<h2 id="title"></h2>
+<table id="attributes"></table>
+<div id="add" hidden>
+<h3>Add to metrics</h3>
+<input id="name" size="40"> <select id="type"><option>gauge</option><option>counter</option><option>untyped</option></select>
+<button id="addbutton">Add</button>
+</div>
+<h3>Children</h3>
+<ul id="children"></ul>
+<script>
+var path = [];
+var current = null;
+
+function text(tag, value) {
+  var e = document.createElement(tag);
+  e.textContent = value;
+  return e;
+}
+
+function message(msg, error) {
+  var m = document.getElementById("message");
+  m.textContent = msg;
+  m.className = error ? "error" : "";
+}
+
+function metricName(n) {
+  return ("opcua_" + n.browse_name).toLowerCase().replace(/[^a-z0-9_:]+/g, "_");
+}
+
+function browse(nodeid, back) {
+  fetch("/browse?node=" + encodeURIComponent(nodeid), {credentials: "same-origin"})
+    .then(function(r) { return r.json().then(function(body) { return {ok: r.ok, body: body}; }); })
+    .then(function(res) {
+      if (!res.ok) { message(res.body.error, true); return; }
+      if (current && !back) { path.push(current.nodeid); }
+      render(res.body);
+    })
+    .catch(function(err) { message(err, true); });
+}
+
+function render(n) {
+  current = n;
+  message("");
+  document.getElementById("nodeid").value = n.nodeid;
+  document.getElementById("title").textContent = n.display_name || n.browse_name;
+  var attrs = document.getElementById("attributes");
+  attrs.innerHTML = "";
+  [["NodeId", n.nodeid], ["NodeClass", n.node_class], ["BrowseName", n.browse_name],
+   ["Description", n.description], ["DataType", n.data_type],
+   ["AccessLevel", (n.access_level || []).join(", ")],
+   ["Value", n.value_error ? n.value_error : (n.value === null ? "" : JSON.stringify(n.value) + (n.value_type ? " (" + n.value_type + ")" : ""))]
+  ].forEach(function(a) {
+    if (a[1] === undefined || a[1] === "") { return; }
+    var tr = document.createElement("tr");
+    tr.appendChild(text("th", a[0]));
+    tr.appendChild(text("td", a[1]));
+    attrs.appendChild(tr);
+  });
+  document.getElementById("add").hidden = n.node_class !== "Variable" || !n.numeric;
+  document.getElementById("name").value = metricName(n);
+  var children = document.getElementById("children");
+  children.innerHTML = "";
+  n.children.forEach(function(c) {
+    var li = document.createElement("li");
+    var a = text("a", c.display_name || c.browse_name);
+    a.onclick = function() { browse(c.nodeid); };
+    li.appendChild(a);
+    li.appendChild(document.createTextNode(" " + c.node_class + " " + c.nodeid));
+    children.appendChild(li);
+  });
+}
+
+document.getElementById("goto").onsubmit = function(e) {
+  e.preventDefault();
+  browse(document.getElementById("nodeid").value);
+};
+document.getElementById("up").onclick = function() {
+  if (path.length > 0) { browse(path.pop(), true); }
+};
+document.getElementById("addbutton").onclick = function() {
+  var metric = {
+    name: document.getElementById("name").value,
+    help: current.description || current.display_name || current.browse_name,
+    nodeid: current.nodeid,
+    type: document.getElementById("type").value
+  };
+  fetch("/api/v1/metrics", {method: "POST", credentials: "same-origin", headers: {"Content-Type": "application/json"}, body: JSON.stringify(metric)})
+    .then(function(r) { return r.json().then(function(body) { return {ok: r.ok, body: body}; }); })
+    .then(function(res) {
+      if (res.ok) { message("metric " + res.body.name + " added with id " + res.body.id); }
+      else { message(res.body.error, true); }
+    })
+    .catch(function(err) { message(err, true); });
+};
+
+browse(new URLSearchParams(location.search).get("node") || "");
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBrowseInvalidNodeID(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"node=" + url.QueryEscape("ns=2;i=-1"), `invalid node id "ns=2;i=-1"`},
+		{"node=" + url.QueryEscape("ns=a;i=1"), `invalid node id "ns=a;i=1"`},
+		{"node=i=abc", `invalid node id "i=abc"`},
+		// without the error the Objects folder would be browsed
+		{"node=ns=2;i=1", "invalid query, escape the ; of node ids as %3B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			// the node id is checked before the server is browsed
+			browseHandler(nopLogger{}, nil)(w, httptest.NewRequest("GET", "/browse?"+tt.query, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if got := apiErrorOf(t, w); !strings.HasPrefix(got, tt.err) {
+				t.Errorf("got error %q, want %q", got, tt.err)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package client
 import (
 	"crypto/rsa"
 	"crypto/tls"
+	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
@@ -12,26 +14,74 @@ import (
 	"github.com/skilld-labs/telemetry-opcua-exporter/log"
 )
 
-func NewClientFromServerConfig(c config.ServerConfig, l log.Logger) *opcua.Client {
-	e := findEndpoint(c, l)
-	crt := loadCertificate(c, l)
+type Endpoint struct {
+	URL            string
+	SecurityPolicy string
+	SecurityMode   string
+	AuthMode       string
+}
+
+func NewClientFromServerConfig(c config.ServerConfig, l log.Logger) (*opcua.Client, *Endpoint, error) {
+	ee, err := opcua.GetEndpoints(c.Endpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get endpoints failed: %v", err)
+	}
+
+	var e *ua.EndpointDescription
+	for _, s := range c.EndpointSelections() {
+		sc := c
+		sc.SecPolicy, sc.SecMode, sc.AuthMode = s.SecPolicy, s.SecMode, s.AuthMode
+		if e, err = findEndpoint(sc, ee); err != nil {
+			l.Warn("endpoint selection %s/%s/%s rejected: %v", s.SecPolicy, s.SecMode, s.AuthMode, err)
+			continue
+		}
+		c = sc
+		break
+	}
+	if e == nil {
+		return nil, nil, fmt.Errorf("unable to find suitable server endpoint with selected security policy, security mode and authentication mode")
+	}
+
+	endpointURL := e.EndpointURL
+	if c.RewriteEndpointHost {
+		endpointURL = rewriteEndpointHost(endpointURL, c.Endpoint)
+	}
+	crt, err := loadCertificate(c)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	o := []opcua.Option{}
 	o = append(o, connectionOptions()...)
 	o = append(o, authenticationOptions(c, l, e, &crt)...)
 	o = append(o, securityOptions(c, l, e, &crt)...)
 
-	l.Info("client using config: Endpoint: %s, Security Mode: %s, %s, Authentication Mode : %s", e.EndpointURL, e.SecurityPolicyURI, e.SecurityMode, c.AuthMode)
+	l.Info("client using config: Endpoint: %s, Security Mode: %s, %s, Authentication Mode : %s", endpointURL, e.SecurityPolicyURI, e.SecurityMode, c.AuthMode)
 
-	return opcua.NewClient(c.Endpoint, o...)
+	return opcua.NewClient(endpointURL, o...), &Endpoint{
+		URL:            endpointURL,
+		SecurityPolicy: strings.TrimPrefix(e.SecurityPolicyURI, ua.SecurityPolicyURIPrefix),
+		SecurityMode:   e.SecurityMode.String(),
+		AuthMode:       c.AuthMode,
+	}, nil
 }
 
-func findEndpoint(c config.ServerConfig, l log.Logger) *ua.EndpointDescription {
-	ee, err := opcua.GetEndpoints(c.Endpoint)
+// rewriteEndpointHost replaces the host of an endpoint advertised by the server
+// with the one of the configured endpoint, keeping the advertised path.
+func rewriteEndpointHost(advertised, configured string) string {
+	a, err := url.Parse(advertised)
 	if err != nil {
-		l.Fatal("get endpoints failed: %v", err)
+		return configured
 	}
+	c, err := url.Parse(configured)
+	if err != nil {
+		return advertised
+	}
+	a.Host = c.Host
+	return a.String()
+}
 
+func findEndpoint(c config.ServerConfig, ee []*ua.EndpointDescription) (*ua.EndpointDescription, error) {
 	var policy string
 	switch {
 	case c.SecPolicy == "auto":
@@ -45,7 +95,7 @@ func findEndpoint(c config.ServerConfig, l log.Logger) *ua.EndpointDescription {
 		c.SecPolicy == "Aes256_Sha256_RsaPss":
 		policy = ua.SecurityPolicyURIPrefix + c.SecPolicy
 	default:
-		l.Fatal("invalid security policy: %s", c.SecPolicy)
+		return nil, fmt.Errorf("invalid security policy: %s", c.SecPolicy)
 	}
 
 	var mode ua.MessageSecurityMode
@@ -58,7 +108,7 @@ func findEndpoint(c config.ServerConfig, l log.Logger) *ua.EndpointDescription {
 	case "signandencrypt":
 		mode = ua.MessageSecurityModeSignAndEncrypt
 	default:
-		l.Fatal("invalid security mode: %s", c.SecMode)
+		return nil, fmt.Errorf("invalid security mode: %s", c.SecMode)
 	}
 
 	// Allow input of only one of security mode or security policy when choosing 'None'
@@ -67,6 +117,21 @@ func findEndpoint(c config.ServerConfig, l log.Logger) *ua.EndpointDescription {
 		policy = ua.SecurityPolicyURINone
 	}
 
+	// Without certificate only the endpoints without message security can be used
+	hasCert := c.CertPath != "" && c.KeyPath != ""
+	if !hasCert {
+		if c.AuthMode == "Certificate" {
+			return nil, fmt.Errorf("authentication mode Certificate requires a certificate and a private key")
+		}
+		var usable []*ua.EndpointDescription
+		for _, e := range ee {
+			if e.SecurityMode == ua.MessageSecurityModeNone {
+				usable = append(usable, e)
+			}
+		}
+		ee = usable
+	}
+
 	// Find the best endpoint based on our input and server recommendation (highest SecurityMode+SecurityLevel)
 	var ep *ua.EndpointDescription
 	switch {
@@ -99,18 +164,21 @@ func findEndpoint(c config.ServerConfig, l log.Logger) *ua.EndpointDescription {
 		}
 	}
 
-	if ep != nil {
-		// Make sure the selected endpoint supports the authentication mode
-		utt := ua.UserTokenTypeFromString(c.AuthMode)
-		for _, t := range ep.UserIdentityTokens {
-			if t.TokenType == utt {
-				return ep
-			}
+	if ep == nil {
+		if !hasCert {
+			return nil, fmt.Errorf("no endpoint with security policy %s and mode %s usable without certificate", c.SecPolicy, c.SecMode)
 		}
+		return nil, fmt.Errorf("no endpoint with security policy %s and mode %s", c.SecPolicy, c.SecMode)
 	}
 
-	l.Fatal("unable to find suitable server endpoint with selected security policy, security mode and authentication mode")
-	return nil
+	// Make sure the selected endpoint supports the authentication mode
+	utt := ua.UserTokenTypeFromString(c.AuthMode)
+	for _, t := range ep.UserIdentityTokens {
+		if t.TokenType == utt {
+			return ep, nil
+		}
+	}
+	return nil, fmt.Errorf("endpoint %s does not support authentication mode %s", ep.EndpointURL, c.AuthMode)
 }
 
 func connectionOptions() []opcua.Option {
@@ -138,8 +206,8 @@ func authenticationOptions(c config.ServerConfig, l log.Logger, e *ua.EndpointDe
 
 func securityOptions(c config.ServerConfig, l log.Logger, e *ua.EndpointDescription, crt *tls.Certificate) []opcua.Option {
 	o := []opcua.Option{}
-	switch c.SecMode {
-	case "Sign", "SignAndEncrypt":
+	switch e.SecurityMode {
+	case ua.MessageSecurityModeSign, ua.MessageSecurityModeSignAndEncrypt:
 		o = append(o,
 			opcua.PrivateKey(crt.PrivateKey.(*rsa.PrivateKey)),
 			opcua.Certificate(crt.Certificate[0]))
@@ -149,19 +217,17 @@ func securityOptions(c config.ServerConfig, l log.Logger, e *ua.EndpointDescript
 	return o
 }
 
-func loadCertificate(c config.ServerConfig, l log.Logger) tls.Certificate {
+func loadCertificate(c config.ServerConfig) (tls.Certificate, error) {
 	var crt tls.Certificate
 	if c.CertPath != "" && c.KeyPath != "" {
 		crt, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
 		if err != nil {
-			l.Fatal("failed to load certificate: %s", err)
-		} else {
-			_, ok := crt.PrivateKey.(*rsa.PrivateKey)
-			if !ok {
-				l.Fatal("invalid private key")
-			}
+			return crt, fmt.Errorf("failed to load certificate: %s", err)
+		}
+		if _, ok := crt.PrivateKey.(*rsa.PrivateKey); !ok {
+			return crt, fmt.Errorf("invalid private key")
 		}
-		return crt
+		return crt, nil
 	}
-	return crt
+	return crt, nil
 }
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+func FindServers(discoveryURL string, serverURIs ...string) ([]*ua.ApplicationDescription, error) {
+	c := opcua.NewClient(discoveryURL, opcua.AutoReconnect(false))
+	if err := c.Dial(context.Background()); err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	req := &ua.FindServersRequest{
+		EndpointURL: discoveryURL,
+		ServerURIs:  serverURIs,
+	}
+	var res *ua.FindServersResponse
+	err := c.Send(req, func(v interface{}) error {
+		r, ok := v.(*ua.FindServersResponse)
+		if !ok {
+			return fmt.Errorf("invalid response type %T", v)
+		}
+		res = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Servers, nil
+}
+
+// ResolveEndpoint asks the discovery server for the current discovery URL of
+// the server registered with applicationURI.
+func ResolveEndpoint(discoveryURL, applicationURI string) (string, error) {
+	ss, err := FindServers(discoveryURL, applicationURI)
+	if err != nil {
+		return "", fmt.Errorf("find servers on %s failed: %w", discoveryURL, err)
+	}
+	for _, s := range ss {
+		if s.ApplicationURI != applicationURI {
+			continue
+		}
+		for _, u := range s.DiscoveryURLs {
+			if _, err := opcua.GetEndpoints(u); err == nil {
+				return u, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no reachable server with application uri %s registered on %s", applicationURI, discoveryURL)
+}
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/uacp"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+const reverseHelloTimeout = 10 * time.Second
+
+// ReverseListener accepts OPC UA ReverseHello connections opened by servers
+// and hands them over to the targets registered with their ServerUri.
+//
+// gopcua can only dial its endpoint, so each target exposes a loopback
+// endpoint proxying the client to the last socket opened by the server.
+type ReverseListener struct {
+	logger  log.Logger
+	ln      net.Listener
+	mu      sync.Mutex
+	targets map[string]*ReverseTarget
+}
+
+type ReverseTarget struct {
+	ServerURI   string
+	logger      log.Logger
+	ln          net.Listener
+	conns       chan *reverseConn
+	ready       chan struct{}
+	once        sync.Once
+	endpointURL string
+}
+
+type reverseConn struct {
+	net.Conn
+	endpointURL string
+}
+
+func ListenReverse(address string, l log.Logger) (*ReverseListener, error) {
+	address = strings.TrimPrefix(address, "opc.tcp://")
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	rl := &ReverseListener{logger: l, ln: ln, targets: map[string]*ReverseTarget{}}
+	l.Info("listening for reverse connections on %s", ln.Addr())
+	go rl.serve()
+	return rl, nil
+}
+
+func (rl *ReverseListener) Target(serverURI string) (*ReverseTarget, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if t, ok := rl.targets[serverURI]; ok {
+		return t, nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	t := &ReverseTarget{
+		ServerURI: serverURI,
+		logger:    rl.logger,
+		ln:        ln,
+		conns:     make(chan *reverseConn, 1),
+		ready:     make(chan struct{}),
+	}
+	rl.targets[serverURI] = t
+	go t.serve()
+	return t, nil
+}
+
+func (rl *ReverseListener) Close() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, t := range rl.targets {
+		t.ln.Close()
+	}
+	return rl.ln.Close()
+}
+
+func (rl *ReverseListener) serve() {
+	for {
+		conn, err := rl.ln.Accept()
+		if err != nil {
+			rl.logger.Info("reverse connect listener stopped: %v", err)
+			return
+		}
+		go rl.handle(conn)
+	}
+}
+
+func (rl *ReverseListener) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(reverseHelloTimeout))
+	typ, body, err := readMessage(conn)
+	if err != nil || typ != "RHEF" {
+		rl.logger.Warn("invalid reverse hello from %s: %s %v", conn.RemoteAddr(), typ, err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	rhe := new(uacp.ReverseHello)
+	if _, err := rhe.Decode(body); err != nil {
+		rl.logger.Warn("cannot decode reverse hello from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	rl.mu.Lock()
+	t, ok := rl.targets[rhe.ServerURI]
+	rl.mu.Unlock()
+	if !ok {
+		rl.logger.Warn("rejecting reverse connection from unknown server %s (%s)", rhe.ServerURI, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	rl.logger.Debug("reverse connection from %s at %s", rhe.ServerURI, conn.RemoteAddr())
+	t.offer(&reverseConn{Conn: conn, endpointURL: rhe.EndpointURL})
+}
+
+// offer keeps only the most recent socket opened by the server.
+func (t *ReverseTarget) offer(rc *reverseConn) {
+	t.once.Do(func() {
+		t.endpointURL = rc.endpointURL
+		close(t.ready)
+	})
+	for {
+		select {
+		case t.conns <- rc:
+			return
+		case old := <-t.conns:
+			old.Close()
+		}
+	}
+}
+
+// EndpointURL waits for the first ReverseHello of the server and returns the
+// loopback endpoint the OPC UA client has to connect to.
+func (t *ReverseTarget) EndpointURL(timeout time.Duration) (string, error) {
+	select {
+	case <-t.ready:
+	case <-time.After(timeout):
+		return "", fmt.Errorf("no reverse connection from %s after %s", t.ServerURI, timeout)
+	}
+	u, err := url.Parse(t.endpointURL)
+	if err != nil {
+		return "", err
+	}
+	u.Host = t.ln.Addr().String()
+	return u.String(), nil
+}
+
+func (t *ReverseTarget) serve() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		go t.proxy(conn)
+	}
+}
+
+func (t *ReverseTarget) proxy(conn net.Conn) {
+	defer conn.Close()
+	var rc *reverseConn
+	select {
+	case rc = <-t.conns:
+	case <-time.After(reverseHelloTimeout):
+		t.logger.Warn("no reverse connection available from %s", t.ServerURI)
+		return
+	}
+	defer rc.Close()
+
+	// the client announces the loopback endpoint, the server expects its own
+	typ, body, err := readMessage(conn)
+	if err != nil || typ != "HELF" {
+		t.logger.Warn("invalid hello from client for %s: %s %v", t.ServerURI, typ, err)
+		return
+	}
+	hel := new(uacp.Hello)
+	if _, err := hel.Decode(body); err != nil {
+		t.logger.Warn("cannot decode hello for %s: %v", t.ServerURI, err)
+		return
+	}
+	hel.EndpointURL = rc.endpointURL
+	if body, err = hel.Encode(); err != nil {
+		t.logger.Warn("cannot encode hello for %s: %v", t.ServerURI, err)
+		return
+	}
+	if err := writeMessage(rc, typ, body); err != nil {
+		t.logger.Warn("cannot forward hello to %s: %v", t.ServerURI, err)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(rc, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, rc)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func readMessage(r io.Reader) (string, []byte, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[4:])
+	if size < 8 || size > uacp.DefaultMaxMessageSize {
+		return "", nil, fmt.Errorf("invalid message size %d", size)
+	}
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", nil, err
+	}
+	return string(hdr[:4]), body, nil
+}
+
+func writeMessage(w io.Writer, typ string, body []byte) error {
+	hdr := make([]byte, 8)
+	copy(hdr, typ)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(body)+8))
+	_, err := w.Write(append(hdr, body...))
+	return err
+}
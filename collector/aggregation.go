@@ -0,0 +1,220 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+)
+
+const (
+	aggregateHistogram = "histogram"
+	aggregateMinMaxAvg = "minmaxavg"
+
+	defaultAggregateWindow = time.Minute
+)
+
+// aggregatedMetric receives every value change of its node through the
+// subscription, instead of the value at scrape time.
+type aggregatedMetric struct {
+	*metric
+	nodeID           *ua.NodeID
+	mode             string
+	samplingInterval time.Duration
+	window           time.Duration
+	state            *aggregationState
+	// skipFirst is set when the state is carried over from the previous
+	// config, the first notification being the value already observed.
+	skipFirst bool
+}
+
+// aggregationState only takes the notifications of its owner into account,
+// so that the subscriptions of the previous and new configs do not both
+// update it during a reload.
+type aggregationState struct {
+	sync.Mutex
+	owner   *aggregatedMetric
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+
+	seen bool
+	last float64
+	// minmaxavg statistics of the current and previous windows, held is the
+	// value held during the previous window
+	start     time.Time
+	cur, prev windowStats
+	held      float64
+	heldSeen  bool
+}
+
+type windowStats struct {
+	min, max, tot float64
+	n             int
+}
+
+func newAggregatedMetric(m config.Metric) (*aggregatedMetric, error) {
+	nodeID, err := ua.ParseNodeID(m.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id: %v", err)
+	}
+	a := &aggregatedMetric{
+		metric:           newConfigMetric(m, prometheus.UntypedValue),
+		nodeID:           nodeID,
+		mode:             m.Aggregate.Mode,
+		samplingInterval: time.Duration(m.Aggregate.SamplingInterval),
+		window:           time.Duration(m.Aggregate.Window),
+		state:            &aggregationState{},
+	}
+	a.state.owner = a
+	if a.window <= 0 {
+		a.window = defaultAggregateWindow
+	}
+	switch a.mode {
+	case aggregateHistogram:
+		buckets := m.Aggregate.Buckets
+		if len(buckets) == 0 {
+			buckets = prometheus.DefBuckets
+		}
+		a.state.buckets = append([]float64(nil), buckets...)
+		sort.Float64s(a.state.buckets)
+		a.state.counts = make([]uint64, len(a.state.buckets))
+	case aggregateMinMaxAvg:
+	default:
+		return nil, fmt.Errorf("unknown aggregation mode %s", a.mode)
+	}
+	return a, nil
+}
+
+// identity is what must be unchanged between two configs for the state of
+// the metric to be carried over.
+func (a *aggregatedMetric) identity() string {
+	return fmt.Sprintf("%s %s %s %v %s", storeKey(a.name, a.properties.labels), a.nodeID, a.mode, a.state.buckets, a.window)
+}
+
+// carryAggregations reuses the states of the unchanged metrics of old in mc.
+func carryAggregations(old, mc *metricsCache) {
+	if old == nil {
+		return
+	}
+	states := map[string]*aggregationState{}
+	for _, a := range old.aggregatedMetricsCache {
+		states[a.identity()] = a.state
+	}
+	for _, a := range mc.aggregatedMetricsCache {
+		if st, ok := states[a.identity()]; ok {
+			a.state, a.skipFirst = st, true
+		}
+	}
+}
+
+// activate makes a the owner of its state, once its config is the current one.
+func (a *aggregatedMetric) activate() {
+	a.state.Lock()
+	a.state.owner = a
+	a.state.Unlock()
+}
+
+func (a *aggregatedMetric) observe(v *ua.DataValue) {
+	if v == nil || v.Status != ua.StatusOK {
+		return
+	}
+	value, err := variantToFloat(v.Value)
+	if err != nil {
+		return
+	}
+	st := a.state
+	st.Lock()
+	defer st.Unlock()
+	if a.skipFirst {
+		a.skipFirst = false
+		return
+	}
+	if st.owner != a {
+		return
+	}
+	switch a.mode {
+	case aggregateHistogram:
+		st.count++
+		st.sum += value
+		for i, b := range st.buckets {
+			if value <= b {
+				st.counts[i]++
+			}
+		}
+	case aggregateMinMaxAvg:
+		a.rotate(time.Now())
+		w := &st.cur
+		if w.n == 0 {
+			w.min, w.max = value, value
+		}
+		w.min = math.Min(w.min, value)
+		w.max = math.Max(w.max, value)
+		w.tot += value
+		w.n++
+	}
+	st.seen, st.last = true, value
+}
+
+// rotate moves to the window containing now, the caller must hold the state
+// lock.
+func (a *aggregatedMetric) rotate(now time.Time) {
+	st := a.state
+	start := now.Truncate(a.window)
+	if start.Equal(st.start) {
+		return
+	}
+	if start.Sub(st.start) == a.window {
+		st.prev = st.cur
+	} else {
+		st.prev = windowStats{}
+	}
+	st.cur = windowStats{}
+	st.start, st.held, st.heldSeen = start, st.last, st.seen
+}
+
+func (a *aggregatedMetric) collect(ch chan<- prometheus.Metric, b seriesBuilder, labels map[string]string) error {
+	st := a.state
+	st.Lock()
+	defer st.Unlock()
+	if !st.seen {
+		return fmt.Errorf("no value received yet")
+	}
+	if a.mode == aggregateHistogram {
+		buckets := map[float64]uint64{}
+		for i, b := range st.buckets {
+			buckets[b] = st.counts[i]
+		}
+		m, err := b.histogram(a.name, a.properties.help, labels, st.count, st.sum, buckets)
+		return send(ch, m, err)
+	}
+
+	a.rotate(time.Now())
+	// without notification during the last window the value did not change
+	min, max, avg := st.last, st.last, st.last
+	if w := st.prev; w.n > 0 {
+		min, max, avg = w.min, w.max, w.tot/float64(w.n)
+	} else if st.heldSeen {
+		min, max, avg = st.held, st.held, st.held
+	}
+	for _, s := range []struct {
+		suffix, help string
+		value        float64
+	}{
+		{"_min", " (minimum over the last window)", min},
+		{"_max", " (maximum over the last window)", max},
+		{"_avg", " (average over the last window)", avg},
+	} {
+		m, err := b.metric(a.name+s.suffix, a.properties.help+s.help, prometheus.GaugeValue, labels, s.value)
+		if err := send(ch, m, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+)
+
+func newTestAggregation(t *testing.T, mode string, buckets ...float64) *aggregatedMetric {
+	t.Helper()
+	a, err := newAggregatedMetric(config.Metric{
+		Name:      "vibration",
+		Help:      "vibration",
+		NodeID:    "ns=2;i=1",
+		Type:      "gauge",
+		Labels:    map[string]string{"spindle": "1"},
+		Aggregate: &config.Aggregate{Mode: mode, Buckets: buckets},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func dataValue(v interface{}) *ua.DataValue {
+	return &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(v)}
+}
+
+func TestAggregationHistogram(t *testing.T) {
+	a := newTestAggregation(t, aggregateHistogram, 5, 1)
+	for _, v := range []interface{}{0.5, 2.0, int32(7), "ignored"} {
+		a.observe(dataValue(v))
+	}
+	a.observe(&ua.DataValue{Status: ua.StatusBadNodeIDUnknown})
+
+	st := a.state
+	if st.count != 3 || st.sum != 9.5 {
+		t.Errorf("got count %d and sum %v, want 3 and 9.5", st.count, st.sum)
+	}
+	// buckets are sorted and cumulative
+	if st.buckets[0] != 1 || st.counts[0] != 1 || st.counts[1] != 2 {
+		t.Errorf("got buckets %v with counts %v, want [1 5] with [1 2]", st.buckets, st.counts)
+	}
+}
+
+func TestCarryAggregations(t *testing.T) {
+	old := newTestAggregation(t, aggregateHistogram)
+	old.observe(dataValue(1.0))
+	changed := newTestAggregation(t, aggregateHistogram, 1, 2)
+	same := newTestAggregation(t, aggregateHistogram)
+
+	carryAggregations(&metricsCache{aggregatedMetricsCache: []*aggregatedMetric{old}},
+		&metricsCache{aggregatedMetricsCache: []*aggregatedMetric{changed, same}})
+	if changed.state == old.state {
+		t.Error("the state was carried over to a metric with different buckets")
+	}
+	if same.state != old.state {
+		t.Fatal("the state was not carried over to the unchanged metric")
+	}
+
+	// until activated, only the metric of the current config is counted
+	same.observe(dataValue(2.0))
+	same.observe(dataValue(3.0))
+	old.observe(dataValue(4.0))
+	if st := same.state; st.count != 2 || st.sum != 5 {
+		t.Errorf("got count %d and sum %v, want 2 and 5", st.count, st.sum)
+	}
+	same.activate()
+	same.observe(dataValue(5.0))
+	old.observe(dataValue(6.0))
+	if st := same.state; st.count != 3 || st.sum != 10 {
+		t.Errorf("got count %d and sum %v, want 3 and 10", st.count, st.sum)
+	}
+}
+
+func TestAggregationWindows(t *testing.T) {
+	a := newTestAggregation(t, aggregateMinMaxAvg)
+	st := a.state
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	a.rotate(start)
+	st.cur = windowStats{min: 1, max: 3, tot: 4, n: 2}
+	st.seen, st.last = true, 3
+
+	a.rotate(start.Add(30 * time.Second))
+	if st.cur.n != 2 {
+		t.Fatal("the window was rotated before its end")
+	}
+	a.rotate(start.Add(a.window))
+	if st.prev != (windowStats{min: 1, max: 3, tot: 4, n: 2}) || st.cur.n != 0 {
+		t.Errorf("got previous window %+v and current %+v after one window", st.prev, st.cur)
+	}
+	// a window without notification is empty, holding the last value
+	a.rotate(start.Add(3 * a.window))
+	if st.prev.n != 0 || !st.heldSeen || st.held != 3 {
+		t.Errorf("got previous window %+v, held %v (%v) after a gap", st.prev, st.held, st.heldSeen)
+	}
+}
@@ -0,0 +1,246 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+// backfiller recovers samples missed during connectivity gaps from the server
+// history and writes them as OpenMetrics files, ready to be imported with
+// `promtool tsdb create-blocks-from openmetrics`. A gap starts when a read
+// fails or the session is lost and ends with the next successful read.
+type backfiller struct {
+	sync.Mutex
+	logger    log.Logger
+	conn      *connection
+	dir       string
+	minGap    time.Duration
+	reachable time.Time
+	gapStart  time.Time
+	done      chan struct{}
+}
+
+type backfillSample struct {
+	value     float64
+	timestamp time.Time
+}
+
+func newBackfiller(conn *connection, dir string, minGap time.Duration, l log.Logger) *backfiller {
+	b := &backfiller{logger: l, conn: conn, dir: dir, minGap: minGap, done: make(chan struct{})}
+	if dir != "" {
+		go b.watch()
+	}
+	return b
+}
+
+// watch notices the session losses happening between scrapes, until close
+// is called.
+func (b *backfiller) watch() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-b.done:
+			return
+		}
+		if b.conn.Client().State() == opcua.Connected {
+			b.Lock()
+			if b.gapStart.IsZero() {
+				b.reachable = time.Now()
+			}
+			b.Unlock()
+		} else {
+			b.failed()
+		}
+	}
+}
+
+// close stops watching the session.
+func (b *backfiller) close() {
+	close(b.done)
+}
+
+// failed records that the server is unreachable, the gap starting when it
+// was last known reachable.
+func (b *backfiller) failed() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	if b.gapStart.IsZero() && !b.reachable.IsZero() {
+		b.gapStart = b.reachable
+	}
+	b.Unlock()
+}
+
+// scraped records a successful read and starts a backfill when it ends a gap
+// longer than minGap.
+func (b *backfiller) scraped(cl *opcua.Client, mc *metricsCache) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	start, end := b.gapStart, time.Now()
+	b.gapStart, b.reachable = time.Time{}, end
+	b.Unlock()
+
+	if b.dir == "" || start.IsZero() || end.Sub(start) < b.minGap {
+		return
+	}
+	b.logger.Info("gap of %s detected, backfilling from %s", end.Sub(start), start.Format(time.RFC3339))
+	go func() {
+		if err := b.backfill(cl, mc, start, end); err != nil {
+			b.logger.Err("backfill failed: %v", err)
+		}
+	}()
+}
+
+func (b *backfiller) backfill(cl *opcua.Client, mc *metricsCache, start, end time.Time) error {
+	samples := map[*opcuaMetric][]backfillSample{}
+	for _, m := range mc.opcuaMetricsCache {
+		ss, err := historyRead(cl, m.nodeReadValueID.NodeID, start, end)
+		if err != nil {
+			b.logger.Warn("history read failed for metric %s (%s): %v", m.name, m.nodeID, err)
+			continue
+		}
+		samples[m] = ss
+	}
+
+	filename := filepath.Join(b.dir, fmt.Sprintf("backfill-%d-%d.om", start.Unix(), end.Unix()))
+	n, err := writeOpenMetrics(filename, mc, samples)
+	if err != nil {
+		return err
+	}
+	b.logger.Info("backfilled %d samples into %s", n, filename)
+	return nil
+}
+
+// historyRead returns the values of nodeID strictly between start and end,
+// the values at the boundaries being the ones of the live scrapes.
+func historyRead(cl *opcua.Client, nodeID *ua.NodeID, start, end time.Time) ([]backfillSample, error) {
+	var ss []backfillSample
+	node := &ua.HistoryReadValueID{NodeID: nodeID}
+	for {
+		resp, err := cl.HistoryReadRawModified([]*ua.HistoryReadValueID{node}, &ua.ReadRawModifiedDetails{
+			StartTime: start,
+			EndTime:   end,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Results) == 0 {
+			return ss, nil
+		}
+		r := resp.Results[0]
+		if r.StatusCode != ua.StatusOK && r.StatusCode != ua.StatusGoodMoreData {
+			return nil, fmt.Errorf("invalid status %v", r.StatusCode)
+		}
+		if r.HistoryData != nil {
+			if data, ok := r.HistoryData.Value.(*ua.HistoryData); ok {
+				for _, v := range data.DataValues {
+					if v.Status != ua.StatusOK || v.Value == nil {
+						continue
+					}
+					ts := v.SourceTimestamp
+					if ts.IsZero() {
+						ts = v.ServerTimestamp
+					}
+					if !ts.After(start) || !ts.Before(end) {
+						continue
+					}
+					value, err := variantToFloat(v.Value)
+					if err != nil {
+						continue
+					}
+					ss = append(ss, backfillSample{value: value, timestamp: ts})
+				}
+			}
+		}
+		if len(r.ContinuationPoint) == 0 {
+			return ss, nil
+		}
+		node.ContinuationPoint = r.ContinuationPoint
+	}
+}
+
+// backfillSeries is an opcua metric as exposed, after relabeling.
+type backfillSeries struct {
+	m      *opcuaMetric
+	labels map[string]string
+}
+
+func writeOpenMetrics(filename string, mc *metricsCache, samples map[*opcuaMetric][]backfillSample) (int, error) {
+	// OpenMetrics requires the samples of a family to be contiguous
+	families := map[string][]backfillSeries{}
+	var names []string
+	for _, m := range mc.opcuaMetricsCache {
+		name, labels, keep := mc.relabel.Process(m.name, m.labelMap(mc.labels))
+		if !keep {
+			continue
+		}
+		if _, ok := families[name]; !ok {
+			names = append(names, name)
+		}
+		families[name] = append(families[name], backfillSeries{m: m, labels: labels})
+	}
+	sort.Strings(names)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	n := 0
+	for _, name := range names {
+		ms := families[name]
+		typ := "unknown"
+		if ms[0].m.properties.typ == prometheus.GaugeValue {
+			typ = "gauge"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(ms[0].m.properties.help), name, typ)
+		for _, m := range ms {
+			ss := samples[m.m]
+			sort.Slice(ss, func(i, j int) bool { return ss[i].timestamp.Before(ss[j].timestamp) })
+			labels := formatLabels(m.labels)
+			for _, s := range ss {
+				fmt.Fprintf(w, "%s%s %v %.3f\n", name, labels, s.value, float64(s.timestamp.UnixNano())/1e9)
+				n++
+			}
+		}
+	}
+	fmt.Fprint(w, "# EOF\n")
+	if err := w.Flush(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var ll []string
+	for k, v := range labels {
+		v = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+		ll = append(ll, fmt.Sprintf("%s=\"%s\"", k, v))
+	}
+	sort.Strings(ll)
+	return "{" + strings.Join(ll, ",") + "}"
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
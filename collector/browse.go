@@ -0,0 +1,236 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// BrowseNode describes a node of the address space and the nodes it
+// organizes.
+type BrowseNode struct {
+	NodeID      string `json:"nodeid"`
+	NodeClass   string `json:"node_class"`
+	BrowseName  string `json:"browse_name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description,omitempty"`
+	DataType    string `json:"data_type,omitempty"`
+	// Numeric is set for the scalar variables the collector can export.
+	Numeric     bool              `json:"numeric"`
+	AccessLevel []string          `json:"access_level,omitempty"`
+	Value       interface{}       `json:"value"`
+	ValueType   string            `json:"value_type,omitempty"`
+	ValueError  string            `json:"value_error,omitempty"`
+	Children    []BrowseReference `json:"children"`
+}
+
+type BrowseReference struct {
+	NodeID      string `json:"nodeid"`
+	NodeClass   string `json:"node_class"`
+	BrowseName  string `json:"browse_name"`
+	DisplayName string `json:"display_name"`
+}
+
+var browseAttributes = []ua.AttributeID{
+	ua.AttributeIDNodeClass,
+	ua.AttributeIDBrowseName,
+	ua.AttributeIDDisplayName,
+	ua.AttributeIDDescription,
+	ua.AttributeIDDataType,
+	ua.AttributeIDAccessLevel,
+	ua.AttributeIDValue,
+}
+
+// Browse reads the attributes of nodeID and its hierarchical children
+// through the collector session, the Objects folder being browsed when
+// nodeID is empty.
+func (c *Collector) Browse(nodeID string) (*BrowseNode, error) {
+	if nodeID == "" {
+		nodeID = ua.NewNumericNodeID(0, id.ObjectsFolder).String()
+	}
+	nid, err := ua.ParseNodeID(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id %q: %v", nodeID, err)
+	}
+	node := c.conn.Client().Node(nid)
+	attrs, err := node.Attributes(browseAttributes...)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) != len(browseAttributes) {
+		return nil, fmt.Errorf("unexpected number of attributes %d", len(attrs))
+	}
+	if attrs[0].Status != ua.StatusOK {
+		return nil, fmt.Errorf("cannot read node %s: %v", nid, attrs[0].Status)
+	}
+
+	n := &BrowseNode{NodeID: nid.String(), Children: []BrowseReference{}}
+	for i, a := range attrs {
+		if a.Status != ua.StatusOK || a.Value == nil {
+			if browseAttributes[i] == ua.AttributeIDValue && a.Status != ua.StatusBadAttributeIDInvalid {
+				n.ValueError = fmt.Sprint(a.Status)
+			}
+			continue
+		}
+		v := a.Value.Value()
+		switch browseAttributes[i] {
+		case ua.AttributeIDNodeClass:
+			if class, ok := v.(int32); ok {
+				n.NodeClass = nodeClass(ua.NodeClass(class))
+			}
+		case ua.AttributeIDBrowseName:
+			if q, ok := v.(*ua.QualifiedName); ok {
+				n.BrowseName = q.Name
+			}
+		case ua.AttributeIDDisplayName:
+			if t, ok := v.(*ua.LocalizedText); ok {
+				n.DisplayName = t.Text
+			}
+		case ua.AttributeIDDescription:
+			if t, ok := v.(*ua.LocalizedText); ok {
+				n.Description = t.Text
+			}
+		case ua.AttributeIDDataType:
+			if dt, ok := v.(*ua.NodeID); ok {
+				n.DataType = dataTypeName(dt)
+				n.Numeric = numericDataType(dt)
+			}
+		case ua.AttributeIDAccessLevel:
+			if level, ok := v.(uint8); ok {
+				n.AccessLevel = accessLevel(ua.AccessLevelType(level))
+			}
+		case ua.AttributeIDValue:
+			if a.Value.ArrayLength() > 0 {
+				n.Numeric = false
+			}
+			n.Value = variantValue(a.Value)
+			n.ValueType = variantType(a.Value)
+		}
+	}
+
+	refs, err := node.References(id.HierarchicalReferences, ua.BrowseDirectionForward, ua.NodeClassAll, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range refs {
+		ref := BrowseReference{NodeClass: nodeClass(r.NodeClass)}
+		if r.NodeID != nil && r.NodeID.NodeID != nil {
+			ref.NodeID = r.NodeID.NodeID.String()
+		}
+		if r.BrowseName != nil {
+			ref.BrowseName = r.BrowseName.Name
+		}
+		if r.DisplayName != nil {
+			ref.DisplayName = r.DisplayName.Text
+		}
+		n.Children = append(n.Children, ref)
+	}
+	return n, nil
+}
+
+func nodeClass(c ua.NodeClass) string {
+	return strings.TrimPrefix(c.String(), "NodeClass")
+}
+
+// dataTypeName returns the name of the standard data types and the node id
+// of the others.
+func dataTypeName(dt *ua.NodeID) string {
+	if dt.Namespace() == 0 && dt.Type() != ua.NodeIDTypeString {
+		if name := id.Name(dt.IntID()); name != "" {
+			return name
+		}
+	}
+	return dt.String()
+}
+
+// numericDataType reports whether the values of dt are exported by a plain
+// metric, which reads them with Variant.Float: the other types would be
+// exported as 0.
+func numericDataType(dt *ua.NodeID) bool {
+	if dt.Namespace() != 0 || dt.Type() == ua.NodeIDTypeString {
+		return false
+	}
+	switch dt.IntID() {
+	case id.Float, id.Double:
+		return true
+	}
+	return false
+}
+
+func accessLevel(level ua.AccessLevelType) []string {
+	var ll []string
+	for _, flag := range []ua.AccessLevelType{
+		ua.AccessLevelTypeCurrentRead,
+		ua.AccessLevelTypeCurrentWrite,
+		ua.AccessLevelTypeHistoryRead,
+		ua.AccessLevelTypeHistoryWrite,
+		ua.AccessLevelTypeSemanticChange,
+		ua.AccessLevelTypeStatusWrite,
+		ua.AccessLevelTypeTimestampWrite,
+	} {
+		if level&flag != 0 {
+			ll = append(ll, strings.TrimPrefix(flag.String(), "AccessLevelType"))
+		}
+	}
+	return ll
+}
+
+func variantType(v *ua.Variant) string {
+	if v == nil {
+		return ""
+	}
+	return strings.TrimPrefix(v.Type().String(), "TypeID")
+}
+
+// variantValue converts the value of v to one which can be encoded in JSON.
+func variantValue(v *ua.Variant) interface{} {
+	if v == nil {
+		return nil
+	}
+	return jsonValue(v.Value())
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, bool, string, int8, uint8, int16, uint16, int32, uint32, int64, uint64:
+		return x
+	case float32:
+		return jsonFloat(float64(x))
+	case float64:
+		return jsonFloat(x)
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return x
+	case *ua.LocalizedText:
+		return x.Text
+	case *ua.QualifiedName:
+		return x.Name
+	case *ua.NodeID:
+		return x.String()
+	case fmt.Stringer:
+		return x.String()
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+		vv := make([]interface{}, rv.Len())
+		for i := range vv {
+			vv[i] = jsonValue(rv.Index(i).Interface())
+		}
+		return vv
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// jsonFloat keeps NaN and infinities, which JSON numbers cannot represent,
+// as strings.
+func jsonFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprint(f)
+	}
+	return f
+}
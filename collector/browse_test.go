@@ -0,0 +1,30 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestNumericDataType(t *testing.T) {
+	tests := []struct {
+		dt   *ua.NodeID
+		want bool
+	}{
+		{ua.NewNumericNodeID(0, id.Float), true},
+		{ua.NewNumericNodeID(0, id.Double), true},
+		// read as 0 by plain metrics
+		{ua.NewNumericNodeID(0, id.Int32), false},
+		{ua.NewNumericNodeID(0, id.Boolean), false},
+		{ua.NewNumericNodeID(0, id.Number), false},
+		{ua.NewNumericNodeID(0, id.String), false},
+		{ua.NewNumericNodeID(2, id.Double), false},
+		{ua.NewStringNodeID(0, "Double"), false},
+	}
+	for _, tt := range tests {
+		if got := numericDataType(tt.dt); got != tt.want {
+			t.Errorf("numericDataType(%s) = %v, want %v", tt.dt, got, tt.want)
+		}
+	}
+}
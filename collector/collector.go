@@ -1,30 +1,86 @@
 package collector
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
 	"github.com/gopcua/opcua/ua"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/skilld-labs/telemetry-opcua-exporter/client"
 	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+	"github.com/skilld-labs/telemetry-opcua-exporter/expr"
 	"github.com/skilld-labs/telemetry-opcua-exporter/log"
 )
 
 type CollectorConfig struct {
-	Config *config.Config
-	Logger log.Logger
+	Config         *config.Config
+	Logger         log.Logger
+	BackfillDir    string
+	BackfillMinGap time.Duration
+	StateFile      string
 }
 
+// Collector exposes the metrics of the current config, replaced on reload,
+// every series going through its relabeling rules.
 type Collector struct {
 	Logger            log.Logger
 	ServerConfig      config.ServerConfig
-	opcuaClient       *opcua.Client
-	opcuaMetricsCache []*opcuaMetric
+	conn              *connection
+	backfill          *backfiller
+	store             *store
 	statsMetricsCache []*metric
+	events            *eventsCollector
+	current           *cacheHolder
+	reloads           *reloadLock
+	descs             *descCache
 	errorDesc         *prometheus.Desc
+	status            *scrapeStatus
+}
+
+// metricsCache holds everything built from a metrics config, it is replaced
+// as a whole on reload.
+type metricsCache struct {
+	opcuaMetricsCache      []*opcuaMetric
+	methodMetricsCache     []*methodMetric
+	computedMetricsCache   []*computedMetric
+	aggregatedMetricsCache []*aggregatedMetric
+	edgeMetricsCache       []*edgeMetric
+	stateMetricsCache      []*stateMetric
+	labels                 *labelResolver
+	relabel                *config.Relabeler
+	subs                   *subscriber
+}
+
+// cacheHolder gives the current metrics cache to the goroutines other than
+// the one reloading it.
+type cacheHolder struct {
+	sync.RWMutex
+	mc *metricsCache
+}
+
+// reloadLock serializes the reloads with Close, no reload being applied once
+// the collector is closed.
+type reloadLock struct {
+	sync.Mutex
+	closed bool
+}
+
+var errClosed = errors.New("the collector is closed")
+
+func (h *cacheHolder) get() *metricsCache {
+	h.RLock()
+	defer h.RUnlock()
+	return h.mc
+}
+
+func (h *cacheHolder) set(mc *metricsCache) {
+	h.Lock()
+	h.mc = mc
+	h.Unlock()
 }
 
 type opcuaMetric struct {
@@ -33,26 +89,49 @@ type opcuaMetric struct {
 	nodeReadValueID *ua.ReadValueID
 }
 
+type computedMetric struct {
+	*metric
+	expr expr.Expr
+}
+
 type metric struct {
 	name       string
 	properties *metricProperties
 }
 
 type metricProperties struct {
-	desc         *prometheus.Desc
+	help         string
 	typ          prometheus.ValueType
 	labels       map[string]string
 	labelsKeys   []string
 	labelsValues []string
+	labelNodes   map[string]string
 }
 
 func NewCollector(cfg *CollectorConfig) (*Collector, error) {
-	var err error
-	c := &Collector{Logger: cfg.Logger, ServerConfig: *cfg.Config.ServerConfig, opcuaClient: client.NewClientFromServerConfig(*cfg.Config.ServerConfig, cfg.Logger)}
-	if err = c.opcuaClient.Connect(context.Background()); err != nil {
-		c.Logger.Fatal("cannot connect opcua client %v", err)
+	conn, err := newConnection(*cfg.Config.ServerConfig, cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+	c := &Collector{Logger: cfg.Logger, ServerConfig: *cfg.Config.ServerConfig, conn: conn}
+	c.backfill = newBackfiller(c.conn, cfg.BackfillDir, cfg.BackfillMinGap, cfg.Logger)
+	c.store = newStore(cfg.StateFile, cfg.Logger)
+	c.status = &scrapeStatus{}
+	c.events = newEventsCollector(c.conn, cfg.Logger)
+	c.current = &cacheHolder{}
+	c.reloads = &reloadLock{}
+	c.descs = newDescCache()
+	// unknown nodes are reported by the scrapes at startup, the server may
+	// still be loading its address space
+	r, err := c.prepare(cfg.Config.MetricsConfig, false)
+	if err != nil {
+		c.backfill.close()
+		c.conn.close()
+		return nil, err
+	}
+	if err := r.Commit(); err != nil {
+		return nil, err
 	}
-	c.ReloadMetrics(cfg.Config.MetricsConfig)
 	c.statsMetricsCache = append(c.statsMetricsCache,
 		newMetric("opcua_scrape_walk_duration_seconds", "Time OPCUA walk/bulkwalk took.", prometheus.GaugeValue, nil),
 		newMetric("opcua_scrape_resp_returned", "RESPs returned from walk.", prometheus.GaugeValue, nil),
@@ -63,36 +142,224 @@ func NewCollector(cfg *CollectorConfig) (*Collector, error) {
 	return c, nil
 }
 
-func (c *Collector) ReloadMetrics(cfg *config.MetricsConfig) {
-	c.loadMetricsCache(cfg)
+// Reload holds the metrics built from a new config, they replace the current
+// ones on Commit.
+type Reload struct {
+	c   *Collector
+	mc  *metricsCache
+	cfg *config.MetricsConfig
 }
 
-func (c Collector) Describe(ch chan<- *prometheus.Desc) {
-	for _, metric := range c.opcuaMetricsCache {
-		ch <- metric.properties.desc
+// Prepare builds the metrics of cfg, checks their nodes exist on the server
+// and subscribes to the ones needing it.
+func (c *Collector) Prepare(cfg *config.MetricsConfig) (*Reload, error) {
+	c.reloads.Lock()
+	defer c.reloads.Unlock()
+	if c.reloads.closed {
+		return nil, errClosed
 	}
-	for _, metric := range c.statsMetricsCache {
-		ch <- metric.properties.desc
+	return c.prepare(cfg, true)
+}
+
+func (c *Collector) prepare(cfg *config.MetricsConfig, strict bool) (*Reload, error) {
+	mc, err := c.loadMetricsCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkNodes(mc, cfg); err != nil {
+		if strict {
+			return nil, err
+		}
+		c.Logger.Warn("%v", err)
+	}
+	carryAggregations(c.current.get(), mc)
+	// label values are part of the store keys of the subscribed metrics
+	mc.labels.refresh()
+	if err := c.subscribe(mc, cfg); err != nil {
+		mc.subs.close()
+		return nil, err
 	}
+	return &Reload{c: c, mc: mc, cfg: cfg}, nil
 }
 
+// Commit replaces the current metrics and deletes their subscriptions. It
+// fails once the collector is closed.
+func (r *Reload) Commit() error {
+	c := r.c
+	c.reloads.Lock()
+	defer c.reloads.Unlock()
+	if c.reloads.closed {
+		r.mc.subs.close()
+		return errClosed
+	}
+	old := c.current.get()
+	c.current.set(r.mc)
+	c.events.activate(r.mc.subs, r.cfg.Events)
+	for _, m := range r.mc.aggregatedMetricsCache {
+		m.activate()
+	}
+	if old != nil {
+		old.subs.close()
+	}
+	return nil
+}
+
+func (c *Collector) subscribe(mc *metricsCache, cfg *config.MetricsConfig) error {
+	mc.subs = newSubscriber(c.conn, c.Logger)
+	if err := c.events.subscribe(mc.subs, cfg.Events); err != nil {
+		return fmt.Errorf("error subscribing to events : %v", err)
+	}
+	for _, m := range mc.aggregatedMetricsCache {
+		if err := mc.subs.monitorValue(m.nodeID, m.samplingInterval, m.observe); err != nil {
+			return fmt.Errorf("error subscribing to metric %s : %v", m.name, err)
+		}
+	}
+	for _, m := range mc.edgeMetricsCache {
+		if err := mc.subs.monitorValue(m.nodeID, 0, m.observe); err != nil {
+			return fmt.Errorf("error subscribing to metric %s : %v", m.name, err)
+		}
+	}
+	for _, m := range mc.stateMetricsCache {
+		if err := mc.subs.monitorValue(m.nodeID, 0, m.observe); err != nil {
+			return fmt.Errorf("error subscribing to metric %s : %v", m.name, err)
+		}
+		mc.subs.onDisconnect(m.disconnected)
+	}
+	return nil
+}
+
+// checkNodes reads the NodeId attribute of every node referenced by the
+// metrics config to make sure they exist on the server, in batches no larger
+// than what the server accepts in a single read.
+func (c *Collector) checkNodes(mc *metricsCache, cfg *config.MetricsConfig) error {
+	var ids []*ua.NodeID
+	for _, m := range mc.opcuaMetricsCache {
+		ids = append(ids, m.nodeReadValueID.NodeID)
+	}
+	for _, m := range mc.methodMetricsCache {
+		ids = append(ids, m.req.ObjectID, m.req.MethodID)
+	}
+	for _, m := range mc.aggregatedMetricsCache {
+		ids = append(ids, m.nodeID)
+	}
+	for _, m := range mc.edgeMetricsCache {
+		ids = append(ids, m.nodeID)
+	}
+	for _, m := range mc.stateMetricsCache {
+		ids = append(ids, m.nodeID)
+	}
+	for _, n := range mc.labels.nodes {
+		ids = append(ids, n.nodeID)
+	}
+	for _, e := range cfg.Events {
+		id, err := ua.ParseNodeID(e.Notifier)
+		if err != nil {
+			return fmt.Errorf("invalid notifier node id: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	batch := c.maxNodesPerRead()
+	if batch == 0 {
+		batch = len(ids)
+	}
+	var unknown []string
+	for start := 0; start < len(ids); start += batch {
+		end := start + batch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var req []*ua.ReadValueID
+		for _, id := range ids[start:end] {
+			req = append(req, &ua.ReadValueID{NodeID: id, AttributeID: ua.AttributeIDNodeID})
+		}
+		resp, err := c.conn.Client().Read(&ua.ReadRequest{NodesToRead: req, TimestampsToReturn: ua.TimestampsToReturnNeither})
+		if err != nil {
+			return fmt.Errorf("cannot check nodes on server: %v", err)
+		}
+		for i, r := range resp.Results {
+			if r.Status != ua.StatusOK && start+i < end {
+				unknown = append(unknown, fmt.Sprintf("%s (%v)", ids[start+i], r.Status))
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown nodes on server: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// maxNodesPerRead returns the MaxNodesPerRead operation limit of the server,
+// 0 meaning no limit. A conservative default is used when it cannot be read.
+func (c *Collector) maxNodesPerRead() int {
+	const defaultMaxNodesPerRead = 100
+	resp, err := c.conn.Client().Read(&ua.ReadRequest{
+		NodesToRead:        []*ua.ReadValueID{{NodeID: ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerRead), AttributeID: ua.AttributeIDValue}},
+		TimestampsToReturn: ua.TimestampsToReturnNeither,
+	})
+	if err != nil || len(resp.Results) != 1 || resp.Results[0].Status != ua.StatusOK || resp.Results[0].Value == nil {
+		return defaultMaxNodesPerRead
+	}
+	return int(resp.Results[0].Value.Uint())
+}
+
+// Describe sends no desc, making the collector unchecked: the series it
+// exposes change with the config and their names and labels are only known
+// once relabeled.
+func (c Collector) Describe(ch chan<- *prometheus.Desc) {}
+
 func (c Collector) Collect(ch chan<- prometheus.Metric) {
 	start := time.Now()
+	defer c.status.done(start)
+	mc := c.current.get()
+	b := seriesBuilder{descs: c.descs, relabel: mc.relabel, labels: mc.labels}
+	c.sendMetric(ch, b, endpointInfoMetric(c.conn.Endpoint()), 1)
+	if err := c.events.collect(ch, b); err != nil {
+		c.status.record(err)
+		ch <- prometheus.NewInvalidMetric(c.errorDesc, err)
+	}
 
-	opcuaResponse, readDuration, err := c.scrapeTarget()
+	opcuaResponse, readDuration, err := c.scrapeTarget(mc)
 	if err != nil {
 		c.Logger.Info("error scraping target : %s", err)
+		c.backfill.failed()
+		if err := c.conn.resolve(); err != nil {
+			c.Logger.Err("error resolving endpoint from discovery server : %s", err)
+		}
+		c.status.record(err)
 		ch <- prometheus.NewInvalidMetric(c.errorDesc, err)
 		return
 	}
 	walkDuration := time.Since(start).Seconds()
+	mc.labels.refresh()
+	c.backfill.scraped(c.conn.Client(), mc)
 
-	for idx, opcuaMetric := range c.opcuaMetricsCache {
+	var samples []expr.Sample
+	for idx, opcuaMetric := range mc.opcuaMetricsCache {
 		value, err := c.getOpcuaValueFromIndex(opcuaResponse, idx)
 		if err != nil {
 			ch <- c.getErrorMetric(opcuaMetric.metric, err)
 		} else {
-			ch <- c.getMetricWithValue(opcuaMetric.metric, value)
+			c.sendMetric(ch, b, opcuaMetric.metric, value)
+			samples = append(samples, opcuaMetric.metric.sample(value))
+		}
+	}
+	samples = append(samples, c.collectMethods(ch, b, mc)...)
+	c.collectComputed(ch, b, mc, samples)
+	for _, m := range mc.aggregatedMetricsCache {
+		if err := m.collect(ch, b, m.labelMap(mc.labels)); err != nil {
+			ch <- c.getErrorMetric(m.metric, err)
+		}
+	}
+	for _, m := range mc.edgeMetricsCache {
+		c.sendMetric(ch, b, m.metric, m.value())
+	}
+	for _, m := range mc.stateMetricsCache {
+		if err := m.collect(ch, b, m.labelMap(mc.labels)); err != nil {
+			ch <- c.getErrorMetric(m.metric, err)
 		}
 	}
 	for _, metric := range c.statsMetricsCache {
@@ -107,37 +374,125 @@ func (c Collector) Collect(ch chan<- prometheus.Metric) {
 		case "opcua_scrape_duration_seconds":
 			value = time.Since(start).Seconds()
 		}
-		ch <- c.getMetricWithValue(metric, value)
+		c.sendMetric(ch, b, metric, value)
+	}
+}
+
+// collectComputed evaluates computed metrics in configuration order, so they
+// can reference the ones defined before them by their configured name and
+// labels.
+func (c Collector) collectComputed(ch chan<- prometheus.Metric, b seriesBuilder, mc *metricsCache, samples []expr.Sample) {
+	for _, m := range mc.computedMetricsCache {
+		value, err := m.expr.Eval(samples)
+		if err != nil {
+			ch <- c.getErrorMetric(m.metric, err)
+			continue
+		}
+		c.sendMetric(ch, b, m.metric, value)
+		samples = append(samples, m.metric.sample(value))
 	}
 }
 
 func (c Collector) getErrorMetric(m *metric, err error) prometheus.Metric {
-	return prometheus.NewInvalidMetric(c.errorDesc, fmt.Errorf("error for metric %s with labels %v (%w)", m.name, m.properties.labels, err))
+	err = fmt.Errorf("error for metric %s with labels %v (%w)", m.name, m.properties.labels, err)
+	c.status.record(err)
+	return prometheus.NewInvalidMetric(c.errorDesc, err)
 }
 
-func (c Collector) getMetricWithValue(m *metric, value float64) prometheus.Metric {
-	metric, err := prometheus.NewConstMetric(m.properties.desc, m.properties.typ, value, m.properties.labelsValues...)
-	if err != nil {
-		return c.getErrorMetric(m, err)
+// sendMetric sends the series of m, unless dropped by relabeling.
+func (c Collector) sendMetric(ch chan<- prometheus.Metric, b seriesBuilder, m *metric, value float64) {
+	metric, err := b.metric(m.name, m.properties.help, m.properties.typ, m.labelMap(b.labels), value)
+	if err := send(ch, metric, err); err != nil {
+		ch <- c.getErrorMetric(m, err)
 	}
-	return metric
 }
 
-func (c *Collector) loadMetricsCache(cfg *config.MetricsConfig) error {
+func (c *Collector) loadMetricsCache(cfg *config.MetricsConfig) (*metricsCache, error) {
+	labels := newLabelResolver(c.conn, c.Logger)
 	var mm []*opcuaMetric
-	for _, m := range cfg.Metrics {
+	var methods []*methodMetric
+	var computed []*computedMetric
+	var aggregated []*aggregatedMetric
+	var edges []*edgeMetric
+	var states []*stateMetric
+	for _, m := range cfg.AllMetrics() {
+		for _, nodeID := range m.LabelNodes {
+			if err := labels.add(nodeID, time.Duration(m.LabelNodesInterval)); err != nil {
+				return nil, err
+			}
+		}
+		if m.States != nil {
+			sm, err := newStateMetric(m, c.store, labels)
+			if err != nil {
+				return nil, fmt.Errorf("invalid state tracking for metric %s: %v", m.Name, err)
+			}
+			states = append(states, sm)
+			continue
+		}
+		if m.Edge != "" {
+			em, err := newEdgeMetric(m, c.store, labels)
+			if err != nil {
+				return nil, fmt.Errorf("invalid edge detection for metric %s: %v", m.Name, err)
+			}
+			edges = append(edges, em)
+			continue
+		}
+		if m.Aggregate != nil {
+			am, err := newAggregatedMetric(m)
+			if err != nil {
+				return nil, fmt.Errorf("invalid aggregation for metric %s: %v", m.Name, err)
+			}
+			aggregated = append(aggregated, am)
+			continue
+		}
+		if m.Computed != "" {
+			e, err := expr.Parse(m.Computed)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expression for metric %s: %v", m.Name, err)
+			}
+			computed = append(computed, &computedMetric{
+				metric: newConfigMetric(m, getMetricValueType(m.Type)),
+				expr:   e,
+			})
+			continue
+		}
+		if m.Method != nil {
+			mm, err := newMethodMetric(m)
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, mm)
+			continue
+		}
 		uaNodeID, err := ua.ParseNodeID(m.NodeID)
 		if err != nil {
-			return fmt.Errorf("invalid node id: %v", err)
+			return nil, fmt.Errorf("invalid node id: %v", err)
 		}
 		mm = append(mm, &opcuaMetric{
 			nodeID:          m.NodeID,
 			nodeReadValueID: &ua.ReadValueID{NodeID: uaNodeID},
-			metric:          newMetric(m.Name, m.Help, getMetricValueType(m.Type), m.Labels),
+			metric:          newConfigMetric(m, getMetricValueType(m.Type)),
 		})
 	}
-	c.opcuaMetricsCache = mm
-	return nil
+	return &metricsCache{
+		relabel:                cfg.Relabeler(),
+		opcuaMetricsCache:      mm,
+		methodMetricsCache:     methods,
+		computedMetricsCache:   computed,
+		aggregatedMetricsCache: aggregated,
+		edgeMetricsCache:       edges,
+		stateMetricsCache:      states,
+		labels:                 labels,
+	}, nil
+}
+
+func endpointInfoMetric(e *client.Endpoint) *metric {
+	return newMetric("opcua_endpoint_info", "Endpoint negotiated with the OPCUA server.", prometheus.GaugeValue, map[string]string{
+		"policy": e.SecurityPolicy,
+		"mode":   e.SecurityMode,
+		"auth":   e.AuthMode,
+		"url":    e.URL,
+	})
 }
 
 func newMetric(name string, help string, typ prometheus.ValueType, labels map[string]string) *metric {
@@ -149,7 +504,7 @@ func newMetric(name string, help string, typ prometheus.ValueType, labels map[st
 	return &metric{
 		name: name,
 		properties: &metricProperties{
-			desc:         prometheus.NewDesc(name, help, keys, nil),
+			help:         help,
 			typ:          typ,
 			labels:       labels,
 			labelsKeys:   keys,
@@ -158,11 +513,20 @@ func newMetric(name string, help string, typ prometheus.ValueType, labels map[st
 	}
 }
 
-func (c *Collector) scrapeTarget() (*ua.ReadResponse, float64, error) {
+// sample returns value as seen by computed expressions, under the configured
+// name and labels.
+func (m *metric) sample(value float64) expr.Sample {
+	return expr.Sample{Name: m.name, Labels: m.properties.labels, Value: value}
+}
+
+func (c *Collector) scrapeTarget(mc *metricsCache) (*ua.ReadResponse, float64, error) {
 	var opcuaNodeIDs []*ua.ReadValueID
-	for _, metric := range c.opcuaMetricsCache {
+	for _, metric := range mc.opcuaMetricsCache {
 		opcuaNodeIDs = append(opcuaNodeIDs, metric.nodeReadValueID)
 	}
+	if len(opcuaNodeIDs) == 0 {
+		return &ua.ReadResponse{}, 0, nil
+	}
 
 	req := &ua.ReadRequest{
 		MaxAge:             2000,
@@ -170,7 +534,7 @@ func (c *Collector) scrapeTarget() (*ua.ReadResponse, float64, error) {
 		TimestampsToReturn: ua.TimestampsToReturnBoth,
 	}
 	start := time.Now()
-	resp, err := c.opcuaClient.Read(req)
+	resp, err := c.conn.Client().Read(req)
 	if err != nil {
 		c.Logger.Err("read failed: %s", err)
 		return nil, -1, err
@@ -205,3 +569,20 @@ func fromMSSToSA(input map[string]string) (result []string) {
 	}
 	return result
 }
+
+// Close stops the backfill, deletes the subscriptions, saves the store and
+// closes the session and secure channel with the server. It waits for a
+// reload in progress.
+func (c *Collector) Close() error {
+	c.reloads.Lock()
+	defer c.reloads.Unlock()
+	c.reloads.closed = true
+	c.backfill.close()
+	if mc := c.current.get(); mc != nil {
+		mc.subs.close()
+	}
+	if err := c.store.close(); err != nil {
+		c.Logger.Err("cannot save state file %s: %v", c.store.path, err)
+	}
+	return c.conn.close()
+}
@@ -0,0 +1,133 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/skilld-labs/telemetry-opcua-exporter/client"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+const reverseConnectTimeout = 5 * time.Minute
+
+type connection struct {
+	sync.RWMutex
+	logger       log.Logger
+	serverConfig config.ServerConfig
+	client       *opcua.Client
+	endpoint     *client.Endpoint
+	reverse      *client.ReverseListener
+}
+
+// newConnection resolves the endpoint of the server and connects to it.
+// Nothing is left open when it fails.
+func newConnection(sc config.ServerConfig, l log.Logger) (*connection, error) {
+	c := &connection{logger: l, serverConfig: sc}
+	if sc.DiscoveryURL != "" {
+		u, err := client.ResolveEndpoint(sc.DiscoveryURL, sc.ApplicationURI)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve endpoint from discovery server: %v", err)
+		}
+		l.Info("discovery server resolved %s to %s", sc.ApplicationURI, u)
+		c.serverConfig.Endpoint = u
+	}
+	if sc.ReverseConnectAddress != "" {
+		var err error
+		if c.reverse, err = client.ListenReverse(sc.ReverseConnectAddress, l); err != nil {
+			return nil, fmt.Errorf("cannot listen for reverse connections: %v", err)
+		}
+		t, err := c.reverse.Target(sc.ServerURI)
+		if err != nil {
+			c.reverse.Close()
+			return nil, fmt.Errorf("cannot register reverse connect target: %v", err)
+		}
+		l.Info("waiting for reverse connection from %s", sc.ServerURI)
+		if c.serverConfig.Endpoint, err = t.EndpointURL(reverseConnectTimeout); err != nil {
+			c.reverse.Close()
+			return nil, err
+		}
+		c.serverConfig.RewriteEndpointHost = true
+	}
+	var err error
+	if c.client, c.endpoint, err = client.NewClientFromServerConfig(c.serverConfig, l); err != nil {
+		if c.reverse != nil {
+			c.reverse.Close()
+		}
+		return nil, err
+	}
+	if err := c.client.Connect(context.Background()); err != nil {
+		c.client.Close()
+		if c.reverse != nil {
+			c.reverse.Close()
+		}
+		return nil, fmt.Errorf("cannot connect opcua client %v", err)
+	}
+	return c, nil
+}
+
+func (c *connection) Client() *opcua.Client {
+	c.RLock()
+	defer c.RUnlock()
+	return c.client
+}
+
+func (c *connection) Endpoint() *client.Endpoint {
+	c.RLock()
+	defer c.RUnlock()
+	return c.endpoint
+}
+
+// resolve asks the discovery server again for the endpoint of the configured
+// server and replaces the client when the endpoint has changed. The current
+// client is kept when the new one cannot be created.
+func (c *connection) resolve() error {
+	c.RLock()
+	sc, current := c.serverConfig, c.client
+	c.RUnlock()
+	if sc.DiscoveryURL == "" || current.State() == opcua.Connected {
+		return nil
+	}
+	u, err := client.ResolveEndpoint(sc.DiscoveryURL, sc.ApplicationURI)
+	if err != nil {
+		return err
+	}
+	if u == sc.Endpoint {
+		return nil
+	}
+	c.logger.Info("discovery server resolved %s to new endpoint %s", sc.ApplicationURI, u)
+	sc.Endpoint = u
+	cl, endpoint, err := client.NewClientFromServerConfig(sc, c.logger)
+	if err != nil {
+		return err
+	}
+	if err := cl.Connect(context.Background()); err != nil {
+		cl.Close()
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	// another scrape may have replaced the client in the meantime
+	if c.client != current {
+		cl.Close()
+		return nil
+	}
+	c.client.Close()
+	c.serverConfig, c.client, c.endpoint = sc, cl, endpoint
+	return nil
+}
+
+func (c *connection) close() error {
+	c.Lock()
+	defer c.Unlock()
+	err := c.client.Close()
+	if c.reverse != nil {
+		if rerr := c.reverse.Close(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+)
+
+const (
+	edgeRising  = "rising"
+	edgeFalling = "falling"
+	edgeBoth    = "both"
+	edgeChange  = "change"
+)
+
+// edgeMetric counts the edges of a boolean node, or the value changes of any
+// node, received through the subscription.
+type edgeMetric struct {
+	*metric
+	nodeID *ua.NodeID
+	mode   string
+	labels *labelResolver
+	store  *store
+	state  *edgeState
+}
+
+type edgeState struct {
+	sync.Mutex
+	seen bool
+	last float64
+}
+
+func newEdgeMetric(m config.Metric, s *store, labels *labelResolver) (*edgeMetric, error) {
+	nodeID, err := ua.ParseNodeID(m.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id: %v", err)
+	}
+	switch m.Edge {
+	case edgeRising, edgeFalling, edgeBoth, edgeChange:
+	default:
+		return nil, fmt.Errorf("unknown edge mode %s", m.Edge)
+	}
+	return &edgeMetric{
+		metric: newConfigMetric(m, prometheus.CounterValue),
+		nodeID: nodeID,
+		mode:   m.Edge,
+		labels: labels,
+		store:  s,
+		state:  &edgeState{},
+	}, nil
+}
+
+func (e *edgeMetric) observe(v *ua.DataValue) {
+	if v == nil || v.Status != ua.StatusOK {
+		return
+	}
+	value, err := variantToFloat(v.Value)
+	if err != nil {
+		return
+	}
+	st := e.state
+	st.Lock()
+	defer st.Unlock()
+	// the first notification carries the current value, not a change
+	if st.seen && e.isEdge(st.last, value) {
+		e.store.add(e.key(), 1)
+	}
+	st.seen, st.last = true, value
+}
+
+func (e *edgeMetric) isEdge(prev, cur float64) bool {
+	switch e.mode {
+	case edgeRising:
+		return prev == 0 && cur != 0
+	case edgeFalling:
+		return prev != 0 && cur == 0
+	case edgeBoth:
+		return (prev == 0) != (cur == 0)
+	default:
+		return prev != cur
+	}
+}
+
+// key identifies the counter in the store, label values read from nodes
+// included.
+func (e *edgeMetric) key() string {
+	return storeKey(e.name, e.labelMap(e.labels))
+}
+
+func (e *edgeMetric) value() float64 {
+	return e.store.get(e.key())
+}
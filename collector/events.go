@@ -0,0 +1,368 @@
+package collector
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+const (
+	eventFilterEncoding            = id.EventFilter_Encoding_DefaultBinary
+	simpleAttributeOperandEncoding = id.SimpleAttributeOperand_Encoding_DefaultBinary
+	literalOperandEncoding         = id.LiteralOperand_Encoding_DefaultBinary
+	elementOperandEncoding         = id.ElementOperand_Encoding_DefaultBinary
+)
+
+// event fields selected by the event filter, in this order
+const (
+	fieldEventType = iota
+	fieldSourceName
+	fieldSeverity
+	fieldConditionName
+	fieldActiveState
+	fieldRetain
+	fieldConditionID
+)
+
+// eventsCollector is shared by the successive metrics caches so that the
+// event counters survive reloads, only the notifications of the active
+// subscriber are taken into account.
+type eventsCollector struct {
+	sync.Mutex
+	logger     log.Logger
+	conn       *connection
+	active     *subscriber
+	counts     map[eventKey]float64
+	alarms     map[string]*alarm
+	typeNames  map[string]string
+	refreshing bool
+}
+
+type eventKey struct {
+	severity string
+	source   string
+	typ      string
+}
+
+type alarm struct {
+	condition string
+	source    string
+	severity  string
+	active    bool
+}
+
+func newEventsCollector(conn *connection, l log.Logger) *eventsCollector {
+	return &eventsCollector{
+		logger:    l,
+		conn:      conn,
+		counts:    map[eventKey]float64{},
+		alarms:    map[string]*alarm{},
+		typeNames: map[string]string{},
+	}
+}
+
+func (e *eventsCollector) subscribe(s *subscriber, ee []config.Event) error {
+	for _, ev := range ee {
+		notifier, err := ua.ParseNodeID(ev.Notifier)
+		if err != nil {
+			return fmt.Errorf("invalid notifier node id: %v", err)
+		}
+		var types []*ua.NodeID
+		for _, t := range ev.Types {
+			typeID, err := ua.ParseNodeID(t)
+			if err != nil {
+				return fmt.Errorf("invalid event type node id: %v", err)
+			}
+			types = append(types, typeID)
+		}
+		roots := types
+		if len(roots) == 0 {
+			roots = []*ua.NodeID{ua.NewNumericNodeID(0, id.BaseEventType)}
+		}
+		e.resolveTypeNames(roots)
+		handle := func(fields []*ua.Variant) { e.handle(s, fields) }
+		if err := s.monitorEvents(notifier, eventFilter(ev.MinSeverity, types), handle); err != nil {
+			return err
+		}
+	}
+	if len(ee) > 0 {
+		s.onReconnect(e.conditionRefresh)
+	}
+	return nil
+}
+
+// activate makes s the subscriber whose events are counted, the alarms of
+// the previous one are dropped and refreshed from the server.
+func (e *eventsCollector) activate(s *subscriber, ee []config.Event) {
+	e.Lock()
+	e.active = s
+	e.alarms = map[string]*alarm{}
+	e.Unlock()
+	if len(ee) == 0 {
+		return
+	}
+	s.Lock()
+	sub := s.sub
+	s.Unlock()
+	e.conditionRefresh(sub)
+}
+
+// conditionRefresh asks the server to send the state of every retained
+// condition again, alarms are reset on the RefreshStartEvent.
+func (e *eventsCollector) conditionRefresh(sub *opcua.Subscription) {
+	if sub == nil {
+		return
+	}
+	res, err := e.conn.Client().Call(&ua.CallMethodRequest{
+		ObjectID:       ua.NewNumericNodeID(0, id.ConditionType),
+		MethodID:       ua.NewNumericNodeID(0, id.ConditionType_ConditionRefresh),
+		InputArguments: []*ua.Variant{ua.MustVariant(sub.SubscriptionID)},
+	})
+	if err != nil {
+		e.logger.Warn("condition refresh failed: %v", err)
+		return
+	}
+	if res.StatusCode != ua.StatusOK {
+		e.logger.Warn("condition refresh failed: %v", res.StatusCode)
+	}
+}
+
+func (e *eventsCollector) handle(s *subscriber, fields []*ua.Variant) {
+	if len(fields) <= fieldConditionID {
+		return
+	}
+	typeID := fields[fieldEventType].NodeID()
+	e.Lock()
+	defer e.Unlock()
+	if s != e.active {
+		return
+	}
+	switch {
+	case isNumericNodeID(typeID, id.RefreshStartEventType):
+		e.refreshing = true
+		e.alarms = map[string]*alarm{}
+		return
+	case isNumericNodeID(typeID, id.RefreshEndEventType):
+		e.refreshing = false
+		return
+	}
+
+	severity := severityLevel(uint16(fields[fieldSeverity].Uint()))
+	source := fields[fieldSourceName].String()
+	if !e.refreshing {
+		e.counts[eventKey{severity: severity, source: source, typ: e.typeName(typeID)}]++
+	}
+
+	conditionID := fields[fieldConditionID].NodeID()
+	if conditionID == nil || conditionID.String() == ua.NewTwoByteNodeID(0).String() {
+		return
+	}
+	if !fields[fieldRetain].Bool() {
+		delete(e.alarms, conditionID.String())
+		return
+	}
+	name := fields[fieldConditionName].String()
+	if name == "" {
+		name = source
+	}
+	e.alarms[conditionID.String()] = &alarm{condition: name, source: source, severity: severity, active: fields[fieldActiveState].Bool()}
+}
+
+// resolveTypeNames reads the browse names of the event types under roots,
+// subtypes included, so that notifications are counted without asking the
+// server. Types unknown to the server are named after their node id.
+func (e *eventsCollector) resolveTypeNames(roots []*ua.NodeID) {
+	names := map[string]string{}
+	queue := roots
+	for _, r := range roots {
+		if bn, err := e.conn.Client().Node(r).BrowseName(); err == nil && bn.Name != "" {
+			names[r.String()] = bn.Name
+		} else if err != nil {
+			e.logger.Warn("cannot read the name of event type %s: %v", r, err)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		refs, err := e.conn.Client().Node(n).References(id.HasSubtype, ua.BrowseDirectionForward, ua.NodeClassObjectType, true)
+		if err != nil {
+			e.logger.Warn("cannot browse the subtypes of event type %s: %v", n, err)
+			continue
+		}
+		for _, r := range refs {
+			if r.NodeID == nil || r.NodeID.NodeID == nil {
+				continue
+			}
+			key := r.NodeID.NodeID.String()
+			if _, ok := names[key]; ok {
+				continue
+			}
+			names[key] = key
+			if r.BrowseName != nil && r.BrowseName.Name != "" {
+				names[key] = r.BrowseName.Name
+			}
+			queue = append(queue, r.NodeID.NodeID)
+		}
+	}
+	e.Lock()
+	for k, v := range names {
+		e.typeNames[k] = v
+	}
+	e.Unlock()
+}
+
+// typeName returns the name of an event type resolved by resolveTypeNames,
+// or its node id. It is called with the lock held.
+func (e *eventsCollector) typeName(typeID *ua.NodeID) string {
+	if typeID == nil {
+		return ""
+	}
+	if name, ok := e.typeNames[typeID.String()]; ok {
+		return name
+	}
+	return typeID.String()
+}
+
+func (e *eventsCollector) collect(ch chan<- prometheus.Metric, b seriesBuilder) error {
+	e.Lock()
+	defer e.Unlock()
+	for k, v := range e.counts {
+		m, err := b.metric("opcua_events_total", "Events received from the OPCUA server.", prometheus.CounterValue,
+			map[string]string{"severity": k.severity, "source": k.source, "type": k.typ}, v)
+		if err := send(ch, m, err); err != nil {
+			return err
+		}
+	}
+	for conditionID, a := range e.alarms {
+		var v float64
+		if a.active {
+			v = 1
+		}
+		m, err := b.metric("opcua_alarm_active", "Conditions retained by the OPCUA server, 1 when active.", prometheus.GaugeValue,
+			map[string]string{"condition": a.condition, "condition_id": conditionID, "source": a.source, "severity": a.severity}, v)
+		if err := send(ch, m, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eventFilter(minSeverity uint16, types []*ua.NodeID) *ua.EventFilter {
+	fields := []struct {
+		typeID uint32
+		path   []string
+		attr   ua.AttributeID
+	}{
+		fieldEventType:     {id.BaseEventType, []string{"EventType"}, ua.AttributeIDValue},
+		fieldSourceName:    {id.BaseEventType, []string{"SourceName"}, ua.AttributeIDValue},
+		fieldSeverity:      {id.BaseEventType, []string{"Severity"}, ua.AttributeIDValue},
+		fieldConditionName: {id.ConditionType, []string{"ConditionName"}, ua.AttributeIDValue},
+		fieldActiveState:   {id.AlarmConditionType, []string{"ActiveState", "Id"}, ua.AttributeIDValue},
+		fieldRetain:        {id.ConditionType, []string{"Retain"}, ua.AttributeIDValue},
+		fieldConditionID:   {id.ConditionType, nil, ua.AttributeIDNodeID},
+	}
+	var selects []*ua.SimpleAttributeOperand
+	for _, f := range fields {
+		selects = append(selects, attributeOperand(f.typeID, f.attr, f.path...))
+	}
+
+	var conditions []*filterNode
+	if minSeverity > 0 {
+		conditions = append(conditions, &filterNode{
+			op: ua.FilterOperatorGreaterThanOrEqual,
+			operands: []*ua.ExtensionObject{
+				extensionObject(simpleAttributeOperandEncoding, attributeOperand(id.BaseEventType, ua.AttributeIDValue, "Severity")),
+				extensionObject(literalOperandEncoding, &ua.LiteralOperand{Value: ua.MustVariant(minSeverity)}),
+			},
+		})
+	}
+	var ofTypes *filterNode
+	for _, t := range types {
+		n := &filterNode{
+			op:       ua.FilterOperatorOfType,
+			operands: []*ua.ExtensionObject{extensionObject(literalOperandEncoding, &ua.LiteralOperand{Value: ua.MustVariant(t)})},
+		}
+		if ofTypes == nil {
+			ofTypes = n
+		} else {
+			ofTypes = &filterNode{op: ua.FilterOperatorOr, children: []*filterNode{ofTypes, n}}
+		}
+	}
+	if ofTypes != nil {
+		conditions = append(conditions, ofTypes)
+	}
+
+	filter := &ua.EventFilter{SelectClauses: selects, WhereClause: &ua.ContentFilter{}}
+	switch len(conditions) {
+	case 1:
+		conditions[0].serialize(filter.WhereClause)
+	case 2:
+		(&filterNode{op: ua.FilterOperatorAnd, children: conditions}).serialize(filter.WhereClause)
+	}
+	return filter
+}
+
+// filterNode is a content filter expression, serialized in pre-order since
+// the server evaluates the first element as the root.
+type filterNode struct {
+	op       ua.FilterOperator
+	operands []*ua.ExtensionObject
+	children []*filterNode
+}
+
+func (n *filterNode) serialize(f *ua.ContentFilter) uint32 {
+	idx := len(f.Elements)
+	el := &ua.ContentFilterElement{FilterOperator: n.op, FilterOperands: n.operands}
+	f.Elements = append(f.Elements, el)
+	for _, c := range n.children {
+		ci := c.serialize(f)
+		el.FilterOperands = append(el.FilterOperands, extensionObject(elementOperandEncoding, &ua.ElementOperand{Index: ci}))
+	}
+	return uint32(idx)
+}
+
+func attributeOperand(typeID uint32, attr ua.AttributeID, path ...string) *ua.SimpleAttributeOperand {
+	var bp []*ua.QualifiedName
+	for _, p := range path {
+		bp = append(bp, &ua.QualifiedName{NamespaceIndex: 0, Name: p})
+	}
+	return &ua.SimpleAttributeOperand{
+		TypeDefinitionID: ua.NewNumericNodeID(0, typeID),
+		BrowsePath:       bp,
+		AttributeID:      attr,
+	}
+}
+
+func extensionObject(encoding uint32, v interface{}) *ua.ExtensionObject {
+	return &ua.ExtensionObject{
+		EncodingMask: ua.ExtensionObjectBinary,
+		TypeID:       ua.NewFourByteExpandedNodeID(0, uint16(encoding)),
+		Value:        v,
+	}
+}
+
+func isNumericNodeID(n *ua.NodeID, i uint32) bool {
+	return n != nil && n.Namespace() == 0 && n.IntID() == i
+}
+
+// severityLevel maps an OPCUA event severity to the ranges of Part 9.
+func severityLevel(s uint16) string {
+	switch {
+	case s > 800:
+		return "high"
+	case s > 600:
+		return "medium_high"
+	case s > 400:
+		return "medium"
+	case s > 200:
+		return "medium_low"
+	default:
+		return "low"
+	}
+}
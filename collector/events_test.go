@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Err(string, ...interface{})   {}
+func (nopLogger) Panic(string, ...interface{}) {}
+func (nopLogger) Fatal(string, ...interface{}) {}
+func (nopLogger) SetVerbosity(string)          {}
+func (nopLogger) Shutdown() error              { return nil }
+
+// collectSeries returns the series sent by collect, by name, with their
+// labels.
+func collectSeries(t *testing.T, collect func(chan<- prometheus.Metric) error) map[string][]*dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 100)
+	if err := collect(ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	series := map[string][]*dto.Metric{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		name := m.Desc().String()
+		series[name] = append(series[name], &pb)
+	}
+	return series
+}
+
+func eventFields(typ uint32, source, condition string, conditionID uint32, active bool) []*ua.Variant {
+	fields := make([]*ua.Variant, fieldConditionID+1)
+	fields[fieldEventType] = ua.MustVariant(ua.NewNumericNodeID(0, typ))
+	fields[fieldSourceName] = ua.MustVariant(source)
+	fields[fieldSeverity] = ua.MustVariant(uint16(700))
+	fields[fieldConditionName] = ua.MustVariant(condition)
+	fields[fieldActiveState] = ua.MustVariant(active)
+	fields[fieldRetain] = ua.MustVariant(true)
+	fields[fieldConditionID] = ua.MustVariant(ua.NewNumericNodeID(2, conditionID))
+	if conditionID == 0 {
+		// not a condition
+		fields[fieldConditionID] = ua.MustVariant(ua.NewTwoByteNodeID(0))
+	}
+	return fields
+}
+
+func TestEventsAlarmSeries(t *testing.T) {
+	e := newEventsCollector(nil, nopLogger{})
+	s := &subscriber{}
+	e.active = s
+	e.typeNames[ua.NewNumericNodeID(0, id.AlarmConditionType).String()] = "AlarmConditionType"
+
+	// two sources raising a condition of the same name
+	e.handle(s, eventFields(id.AlarmConditionType, "pump1", "HighTemperature", 1, true))
+	e.handle(s, eventFields(id.AlarmConditionType, "pump2", "HighTemperature", 2, false))
+	// events of another subscriber are ignored
+	e.handle(&subscriber{}, eventFields(id.AlarmConditionType, "pump3", "HighTemperature", 3, true))
+	// an unresolved type is named after its node id
+	e.handle(s, eventFields(id.BaseEventType, "pump1", "", 0, false))
+
+	series := collectSeries(t, func(ch chan<- prometheus.Metric) error {
+		return e.collect(ch, seriesBuilder{descs: newDescCache()})
+	})
+	var alarms, events []*dto.Metric
+	for name, ss := range series {
+		switch {
+		case strings.Contains(name, "opcua_alarm_active"):
+			alarms = append(alarms, ss...)
+		case strings.Contains(name, "opcua_events_total"):
+			events = append(events, ss...)
+		}
+	}
+	if len(alarms) != 2 {
+		t.Fatalf("got %d alarm series, want 2", len(alarms))
+	}
+	seen := map[string]bool{}
+	for _, a := range alarms {
+		labels := labelPairs(a)
+		key := labels["condition"] + "|" + labels["condition_id"] + "|" + labels["source"]
+		if seen[key] {
+			t.Errorf("duplicate alarm series %s", key)
+		}
+		seen[key] = true
+		want := 0.0
+		if labels["source"] == "pump1" {
+			want = 1
+		}
+		if a.GetGauge().GetValue() != want {
+			t.Errorf("alarm of %s: got %v, want %v", labels["source"], a.GetGauge().GetValue(), want)
+		}
+	}
+	types := map[string]bool{}
+	for _, ev := range events {
+		types[labelPairs(ev)["type"]] = true
+	}
+	for _, want := range []string{"AlarmConditionType", ua.NewNumericNodeID(0, id.BaseEventType).String()} {
+		if !types[want] {
+			t.Errorf("missing events of type %q in %v", want, types)
+		}
+	}
+}
+
+func TestSeverityLevel(t *testing.T) {
+	tests := []struct {
+		severity uint16
+		want     string
+	}{
+		{0, "low"},
+		{200, "low"},
+		{201, "medium_low"},
+		{500, "medium"},
+		{700, "medium_high"},
+		{801, "high"},
+		{1000, "high"},
+	}
+	for _, tt := range tests {
+		if got := severityLevel(tt.severity); got != tt.want {
+			t.Errorf("severityLevel(%d) = %q, want %q", tt.severity, got, tt.want)
+		}
+	}
+}
+
+func labelPairs(m *dto.Metric) map[string]string {
+	labels := map[string]string{}
+	for _, lp := range m.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	return labels
+}
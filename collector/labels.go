@@ -0,0 +1,162 @@
+package collector
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+const defaultLabelNodesInterval = time.Minute
+
+// labelResolver reads the nodes providing label values, each one at most
+// once per the smallest interval configured for it.
+type labelResolver struct {
+	sync.Mutex
+	logger log.Logger
+	conn   *connection
+	nodes  map[string]*labelNode
+	// refreshing serializes the refreshes, the nodes being read without
+	// holding the lock so scrapes are not blocked on the server
+	refreshing sync.Mutex
+}
+
+type labelNode struct {
+	nodeID    *ua.NodeID
+	interval  time.Duration
+	value     string
+	refreshed time.Time
+}
+
+func newLabelResolver(conn *connection, l log.Logger) *labelResolver {
+	return &labelResolver{logger: l, conn: conn, nodes: map[string]*labelNode{}}
+}
+
+func (r *labelResolver) add(nodeID string, interval time.Duration) error {
+	id, err := ua.ParseNodeID(nodeID)
+	if err != nil {
+		return fmt.Errorf("invalid label node id: %v", err)
+	}
+	if interval == 0 {
+		interval = defaultLabelNodesInterval
+	}
+	r.Lock()
+	defer r.Unlock()
+	if n, ok := r.nodes[nodeID]; ok {
+		if interval < n.interval {
+			n.interval = interval
+		}
+		return nil
+	}
+	r.nodes[nodeID] = &labelNode{nodeID: id, interval: interval}
+	return nil
+}
+
+func (r *labelResolver) refresh() {
+	r.refreshing.Lock()
+	defer r.refreshing.Unlock()
+	r.Lock()
+	var due []*labelNode
+	var req []*ua.ReadValueID
+	for _, n := range r.nodes {
+		if time.Since(n.refreshed) >= n.interval {
+			due = append(due, n)
+			req = append(req, &ua.ReadValueID{NodeID: n.nodeID})
+		}
+	}
+	r.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	resp, err := r.conn.Client().Read(&ua.ReadRequest{NodesToRead: req, TimestampsToReturn: ua.TimestampsToReturnNeither})
+	if err != nil {
+		r.logger.Warn("cannot read label nodes: %v", err)
+		return
+	}
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	for i, res := range resp.Results {
+		if i >= len(due) {
+			break
+		}
+		if res.Status != ua.StatusOK || res.Value == nil {
+			r.logger.Warn("cannot read label node %s: %v", due[i].nodeID, res.Status)
+			continue
+		}
+		due[i].value = variantToString(res.Value)
+		due[i].refreshed = now
+	}
+}
+
+func (r *labelResolver) value(nodeID string) string {
+	r.Lock()
+	defer r.Unlock()
+	if n, ok := r.nodes[nodeID]; ok {
+		return n.value
+	}
+	return ""
+}
+
+// newConfigMetric creates the metric of a configuration entry, with the
+// labels read from nodes added to its static labels.
+func newConfigMetric(m config.Metric, typ prometheus.ValueType) *metric {
+	if len(m.LabelNodes) == 0 {
+		return newMetric(m.Name, m.Help, typ, m.Labels)
+	}
+	labels := map[string]string{}
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	for k := range m.LabelNodes {
+		labels[k] = ""
+	}
+	mm := newMetric(m.Name, m.Help, typ, labels)
+	mm.properties.labelNodes = m.LabelNodes
+	return mm
+}
+
+// labelValues returns the label values of m in the order of its desc.
+func (m *metric) labelValues(r *labelResolver) []string {
+	if len(m.properties.labelNodes) == 0 || r == nil {
+		return m.properties.labelsValues
+	}
+	values := make([]string, len(m.properties.labelsKeys))
+	for i, k := range m.properties.labelsKeys {
+		if nodeID, ok := m.properties.labelNodes[k]; ok {
+			values[i] = r.value(nodeID)
+		} else {
+			values[i] = m.properties.labelsValues[i]
+		}
+	}
+	return values
+}
+
+// labelMap returns the labels of m, including the values read from nodes.
+func (m *metric) labelMap(r *labelResolver) map[string]string {
+	values := m.labelValues(r)
+	labels := make(map[string]string, len(values))
+	for i, k := range m.properties.labelsKeys {
+		labels[k] = values[i]
+	}
+	return labels
+}
+
+func variantToString(v *ua.Variant) string {
+	switch x := v.Value().(type) {
+	case string:
+		return x
+	case *ua.LocalizedText:
+		return x.Text
+	case *ua.QualifiedName:
+		return x.Name
+	case []byte:
+		return string(x)
+	default:
+		return fmt.Sprint(x)
+	}
+}
@@ -0,0 +1,49 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+)
+
+func TestLabelResolverInterval(t *testing.T) {
+	r := newLabelResolver(nil, nopLogger{})
+	for _, interval := range []time.Duration{0, 10 * time.Second, time.Hour} {
+		if err := r.add("ns=2;s=Line", interval); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := r.nodes["ns=2;s=Line"].interval; got != 10*time.Second {
+		t.Errorf("got interval %v, want the smallest one", got)
+	}
+	if err := r.add("ns=2;i=Line", 0); err == nil {
+		t.Error("invalid node id accepted")
+	}
+}
+
+func TestLabelMap(t *testing.T) {
+	r := newLabelResolver(nil, nopLogger{})
+	if err := r.add("ns=2;s=Line", 0); err != nil {
+		t.Fatal(err)
+	}
+	m := newConfigMetric(config.Metric{
+		Name:       "temperature",
+		Help:       "temperature",
+		Labels:     map[string]string{"site": "lyon"},
+		LabelNodes: map[string]string{"line": "ns=2;s=Line", "unknown": "ns=2;s=Other"},
+	}, prometheus.GaugeValue)
+
+	// until read, the values of the label nodes are empty
+	want := map[string]string{"site": "lyon", "line": "", "unknown": ""}
+	if got := m.labelMap(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	r.nodes["ns=2;s=Line"].value = "a"
+	want["line"] = "a"
+	if got := m.labelMap(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
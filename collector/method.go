@@ -0,0 +1,128 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+	"github.com/skilld-labs/telemetry-opcua-exporter/expr"
+)
+
+type methodMetric struct {
+	*metric
+	req      *ua.CallMethodRequest
+	key      string
+	output   int
+	interval time.Duration
+	state    *methodState
+}
+
+type methodState struct {
+	sync.Mutex
+	result   *ua.CallMethodResult
+	err      error
+	calledAt time.Time
+}
+
+func newMethodMetric(m config.Metric) (*methodMetric, error) {
+	objectID, err := ua.ParseNodeID(m.Method.ObjectID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object id: %v", err)
+	}
+	methodID, err := ua.ParseNodeID(m.Method.MethodID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid method id: %v", err)
+	}
+	var inputs []*ua.Variant
+	var key []string
+	for _, a := range m.Method.Inputs {
+		v, err := a.Variant()
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, v)
+		key = append(key, a.Type+"="+a.Value)
+	}
+	return &methodMetric{
+		metric:   newConfigMetric(m, getMetricValueType(m.Type)),
+		req:      &ua.CallMethodRequest{ObjectID: objectID, MethodID: methodID, InputArguments: inputs},
+		key:      m.Method.ObjectID + "|" + m.Method.MethodID + "|" + strings.Join(key, ","),
+		output:   m.Method.Output,
+		interval: time.Duration(m.Method.Interval),
+		state:    &methodState{},
+	}, nil
+}
+
+// collectMethods calls each configured method once per scrape, or once per
+// interval when one is set, and exports the selected output arguments.
+func (c Collector) collectMethods(ch chan<- prometheus.Metric, b seriesBuilder, mc *metricsCache) []expr.Sample {
+	var samples []expr.Sample
+	results := map[string]*methodState{}
+	for _, m := range mc.methodMetricsCache {
+		st, ok := results[m.key]
+		if !ok {
+			st = m.state
+			st.Lock()
+			if m.interval == 0 || time.Since(st.calledAt) >= m.interval {
+				st.result, st.err = c.conn.Client().Call(m.req)
+				st.calledAt = time.Now()
+			}
+			st.Unlock()
+			results[m.key] = st
+		}
+
+		value, err := methodOutput(st, m.output)
+		if err != nil {
+			ch <- c.getErrorMetric(m.metric, err)
+			continue
+		}
+		c.sendMetric(ch, b, m.metric, value)
+		samples = append(samples, m.metric.sample(value))
+	}
+	return samples
+}
+
+func methodOutput(st *methodState, output int) (float64, error) {
+	st.Lock()
+	defer st.Unlock()
+	if st.err != nil {
+		return -1, st.err
+	}
+	if st.result.StatusCode != ua.StatusOK {
+		return -1, fmt.Errorf("invalid status %v", st.result.StatusCode)
+	}
+	if output < 0 || output >= len(st.result.OutputArguments) {
+		return -1, fmt.Errorf("method returned %d output arguments, output %d requested", len(st.result.OutputArguments), output)
+	}
+	return variantToFloat(st.result.OutputArguments[output])
+}
+
+func variantToFloat(v *ua.Variant) (float64, error) {
+	if v == nil {
+		return -1, fmt.Errorf("empty value")
+	}
+	if v.ArrayLength() > 0 {
+		return -1, fmt.Errorf("unsupported array value")
+	}
+	switch v.Type() {
+	case ua.TypeIDFloat, ua.TypeIDDouble:
+		return v.Float(), nil
+	case ua.TypeIDSByte, ua.TypeIDInt16, ua.TypeIDInt32, ua.TypeIDInt64:
+		return float64(v.Int()), nil
+	case ua.TypeIDByte, ua.TypeIDUint16, ua.TypeIDUint32, ua.TypeIDUint64:
+		return float64(v.Uint()), nil
+	case ua.TypeIDBoolean:
+		if v.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	case ua.TypeIDDateTime:
+		return float64(v.Time().UnixNano()) / 1e9, nil
+	default:
+		return -1, fmt.Errorf("unsupported value type %v", v.Type())
+	}
+}
@@ -0,0 +1,91 @@
+package collector
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestVariantToFloat(t *testing.T) {
+	now := time.Unix(1600000000, 500000000)
+	tests := []struct {
+		name string
+		v    *ua.Variant
+		want float64
+		err  string
+	}{
+		{name: "nil", v: nil, err: "empty value"},
+		{name: "float", v: ua.MustVariant(float32(1.5)), want: 1.5},
+		{name: "double", v: ua.MustVariant(-2.25), want: -2.25},
+		{name: "sbyte", v: ua.MustVariant(int8(-3)), want: -3},
+		{name: "int16", v: ua.MustVariant(int16(-300)), want: -300},
+		{name: "int32", v: ua.MustVariant(int32(70000)), want: 70000},
+		{name: "int64", v: ua.MustVariant(int64(-1) << 40), want: -(1 << 40)},
+		{name: "byte", v: ua.MustVariant(uint8(200)), want: 200},
+		{name: "uint16", v: ua.MustVariant(uint16(60000)), want: 60000},
+		{name: "uint32", v: ua.MustVariant(uint32(4000000000)), want: 4000000000},
+		{name: "uint64", v: ua.MustVariant(uint64(1) << 50), want: 1 << 50},
+		{name: "true", v: ua.MustVariant(true), want: 1},
+		{name: "false", v: ua.MustVariant(false), want: 0},
+		{name: "datetime", v: ua.MustVariant(now), want: 1600000000.5},
+		{name: "string", v: ua.MustVariant("42"), err: "unsupported value type"},
+		{name: "array", v: ua.MustVariant([]float64{1, 2}), err: "unsupported array value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := variantToFloat(tt.v)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMethodOutput(t *testing.T) {
+	result := &ua.CallMethodResult{
+		StatusCode:      ua.StatusOK,
+		OutputArguments: []*ua.Variant{ua.MustVariant(int32(7)), ua.MustVariant(2.5)},
+	}
+	tests := []struct {
+		name   string
+		st     *methodState
+		output int
+		want   float64
+		err    string
+	}{
+		{name: "first output", st: &methodState{result: result}, output: 0, want: 7},
+		{name: "second output", st: &methodState{result: result}, output: 1, want: 2.5},
+		{name: "missing output", st: &methodState{result: result}, output: 2, err: "method returned 2 output arguments, output 2 requested"},
+		{name: "call error", st: &methodState{err: errors.New("timeout")}, err: "timeout"},
+		{name: "bad status", st: &methodState{result: &ua.CallMethodResult{StatusCode: ua.StatusBadMethodInvalid}}, err: "invalid status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := methodOutput(tt.st, tt.output)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package collector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// ReadResult is the DataValue returned by the server for one attribute.
+type ReadResult struct {
+	NodeID            string      `json:"nodeid"`
+	Attribute         string      `json:"attribute"`
+	Status            string      `json:"status"`
+	StatusCode        string      `json:"status_code"`
+	StatusText        string      `json:"status_text,omitempty"`
+	VariantType       string      `json:"variant_type,omitempty"`
+	ArrayDimensions   []int32     `json:"array_dimensions,omitempty"`
+	Value             interface{} `json:"value"`
+	SourceTimestamp   *time.Time  `json:"source_timestamp,omitempty"`
+	SourcePicoseconds uint16      `json:"source_picoseconds,omitempty"`
+	ServerTimestamp   *time.Time  `json:"server_timestamp,omitempty"`
+	ServerPicoseconds uint16      `json:"server_picoseconds,omitempty"`
+}
+
+// ParseAttributeID accepts an attribute name, such as Value or DisplayName,
+// or its numeric id.
+func ParseAttributeID(s string) (ua.AttributeID, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		if n == 0 || n > uint64(ua.AttributeIDAccessLevelEx) {
+			return 0, fmt.Errorf("unknown attribute %s", s)
+		}
+		return ua.AttributeID(n), nil
+	}
+	for a := ua.AttributeIDNodeID; a <= ua.AttributeIDAccessLevelEx; a++ {
+		if strings.EqualFold(strings.TrimPrefix(a.String(), "AttributeID"), s) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown attribute %s", s)
+}
+
+// Read reads a single attribute of nodeID through the collector session,
+// bypassing the configured metrics.
+func (c *Collector) Read(nodeID string, attribute ua.AttributeID) (*ReadResult, error) {
+	nid, err := ua.ParseNodeID(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id %q: %v", nodeID, err)
+	}
+	resp, err := c.conn.Client().Read(&ua.ReadRequest{
+		NodesToRead:        []*ua.ReadValueID{{NodeID: nid, AttributeID: attribute}},
+		TimestampsToReturn: ua.TimestampsToReturnBoth,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Results) != 1 {
+		return nil, fmt.Errorf("unexpected number of results %d", len(resp.Results))
+	}
+	dv := resp.Results[0]
+	r := &ReadResult{
+		NodeID:            nid.String(),
+		Attribute:         strings.TrimPrefix(attribute.String(), "AttributeID"),
+		StatusCode:        fmt.Sprintf("0x%08X", uint32(dv.Status)),
+		SourcePicoseconds: dv.SourcePicoseconds,
+		ServerPicoseconds: dv.ServerPicoseconds,
+	}
+	if d, ok := ua.StatusCodes[dv.Status]; ok {
+		r.Status, r.StatusText = strings.TrimPrefix(d.Name, "Status"), d.Text
+	} else {
+		r.Status = r.StatusCode
+	}
+	if dv.Value != nil {
+		r.VariantType = variantType(dv.Value)
+		r.ArrayDimensions = dv.Value.ArrayDimensions()
+		r.Value = variantValue(dv.Value)
+	}
+	if !dv.SourceTimestamp.IsZero() {
+		t := dv.SourceTimestamp.UTC()
+		r.SourceTimestamp = &t
+	}
+	if !dv.ServerTimestamp.IsZero() {
+		t := dv.ServerTimestamp.UTC()
+		r.ServerTimestamp = &t
+	}
+	return r, nil
+}
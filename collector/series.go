@@ -0,0 +1,99 @@
+package collector
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+)
+
+// seriesBuilder builds the series exposed by a scrape, after applying the
+// relabeling rules of the config to their final name and labels.
+type seriesBuilder struct {
+	descs   *descCache
+	relabel *config.Relabeler
+	labels  *labelResolver
+}
+
+// descCache keeps the descs of the exposed series by name, help and label
+// names, which are only known once relabeled.
+type descCache struct {
+	sync.Mutex
+	descs map[string]*prometheus.Desc
+}
+
+func newDescCache() *descCache {
+	return &descCache{descs: map[string]*prometheus.Desc{}}
+}
+
+func (d *descCache) get(name, help string, keys []string) *prometheus.Desc {
+	key := name + "\x00" + help + "\x00" + strings.Join(keys, "\x00")
+	d.Lock()
+	defer d.Unlock()
+	desc, ok := d.descs[key]
+	if !ok {
+		desc = prometheus.NewDesc(name, help, keys, nil)
+		d.descs[key] = desc
+	}
+	return desc
+}
+
+// desc relabels a series and returns its desc and label values, nil when
+// the series is dropped.
+func (b seriesBuilder) desc(name, help string, labels map[string]string) (*prometheus.Desc, []string) {
+	name, labels, keep := b.relabel.Process(name, labels)
+	if !keep {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = labels[k]
+	}
+	return b.descs.get(name, help, keys), values
+}
+
+// metric returns the series name{labels}, nil when it is dropped.
+func (b seriesBuilder) metric(name, help string, typ prometheus.ValueType, labels map[string]string, value float64) (prometheus.Metric, error) {
+	desc, values := b.desc(name, help, labels)
+	if desc == nil {
+		return nil, nil
+	}
+	return prometheus.NewConstMetric(desc, typ, value, values...)
+}
+
+// histogram returns the histogram name{labels}, nil when it is dropped.
+func (b seriesBuilder) histogram(name, help string, labels map[string]string, count uint64, sum float64, buckets map[float64]uint64) (prometheus.Metric, error) {
+	desc, values := b.desc(name, help, labels)
+	if desc == nil {
+		return nil, nil
+	}
+	return prometheus.NewConstHistogram(desc, count, sum, buckets, values...)
+}
+
+// send sends m unless it was dropped.
+func send(ch chan<- prometheus.Metric, m prometheus.Metric, err error) error {
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		ch <- m
+	}
+	return nil
+}
+
+// withLabel returns a copy of labels with name set to value.
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	ll := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		ll[k] = v
+	}
+	ll[name] = value
+	return ll
+}
@@ -0,0 +1,138 @@
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+)
+
+// stateMetric tracks the time spent by a machine in each value of an
+// enum/integer state node, accumulated from subscription notifications.
+type stateMetric struct {
+	*metric
+	nodeID *ua.NodeID
+	names  map[int64]string
+	labels *labelResolver
+	store  *store
+	state  *machineState
+}
+
+type machineState struct {
+	sync.Mutex
+	seen  bool
+	value int64
+	since time.Time
+}
+
+func newStateMetric(m config.Metric, s *store, labels *labelResolver) (*stateMetric, error) {
+	nodeID, err := ua.ParseNodeID(m.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id: %v", err)
+	}
+	sm := &stateMetric{
+		metric: newConfigMetric(m, prometheus.GaugeValue),
+		nodeID: nodeID,
+		names:  map[int64]string{},
+		labels: labels,
+		store:  s,
+		state:  &machineState{},
+	}
+	for k, v := range m.States {
+		sm.names[k] = v
+	}
+	return sm, nil
+}
+
+func (s *stateMetric) stateName(v int64) string {
+	if name, ok := s.names[v]; ok {
+		return name
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// key identifies the time spent in state in the store, label values read
+// from nodes included.
+func (s *stateMetric) key(state string) string {
+	labels := s.labelMap(s.labels)
+	labels["state"] = state
+	return storeKey(s.name+"_state_seconds_total", labels)
+}
+
+func (s *stateMetric) observe(v *ua.DataValue) {
+	if v == nil || v.Status != ua.StatusOK {
+		return
+	}
+	value, err := variantToFloat(v.Value)
+	if err != nil {
+		return
+	}
+	st := s.state
+	st.Lock()
+	defer st.Unlock()
+	now := time.Now()
+	s.accumulate(now)
+	st.seen, st.value, st.since = true, int64(value), now
+}
+
+// accumulate adds the time spent in the current state up to now, the caller
+// must hold the state lock.
+func (s *stateMetric) accumulate(now time.Time) {
+	st := s.state
+	if !st.seen {
+		return
+	}
+	s.store.add(s.key(s.stateName(st.value)), now.Sub(st.since).Seconds())
+	st.since = now
+}
+
+// disconnected stops accumulating time until the next notification, the
+// state being unknown while the session is lost.
+func (s *stateMetric) disconnected() {
+	st := s.state
+	st.Lock()
+	defer st.Unlock()
+	s.accumulate(time.Now())
+	st.seen = false
+}
+
+func (s *stateMetric) collect(ch chan<- prometheus.Metric, b seriesBuilder, labels map[string]string) error {
+	st := s.state
+	st.Lock()
+	s.accumulate(time.Now())
+	seen, value := st.seen, st.value
+	st.Unlock()
+
+	// report every state known from the configuration or the store
+	states := map[string]bool{}
+	for _, name := range s.names {
+		states[name] = true
+	}
+	if seen {
+		states[s.stateName(value)] = true
+	}
+	for _, name := range s.store.labelValues(s.name+"_state_seconds_total", s.labelMap(s.labels), "state") {
+		states[name] = true
+	}
+	var ss []string
+	for name := range states {
+		ss = append(ss, name)
+	}
+	sort.Strings(ss)
+	for _, name := range ss {
+		m, err := b.metric(s.name+"_state_seconds_total", s.properties.help+" (seconds spent in each state)", prometheus.CounterValue, withLabel(labels, "state", name), s.store.get(s.key(name)))
+		if err := send(ch, m, err); err != nil {
+			return err
+		}
+	}
+	if !seen {
+		return fmt.Errorf("no value received yet")
+	}
+	m, err := b.metric(s.name, s.properties.help, prometheus.GaugeValue, labels, float64(value))
+	return send(ch, m, err)
+}
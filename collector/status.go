@@ -0,0 +1,74 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/skilld-labs/telemetry-opcua-exporter/client"
+)
+
+// Status describes the connection to the server and the last scrape.
+type Status struct {
+	Endpoint           client.Endpoint
+	Connection         string
+	Connected          bool
+	Metrics            int
+	LastScrape         time.Time
+	LastScrapeDuration time.Duration
+	LastScrapeErrors   []string
+}
+
+// scrapeStatus gathers the errors of the scrape in progress and keeps the
+// ones of the last completed scrape.
+type scrapeStatus struct {
+	sync.Mutex
+	last     time.Time
+	duration time.Duration
+	errors   []string
+	pending  []string
+}
+
+func (s *scrapeStatus) record(err error) {
+	s.Lock()
+	s.pending = append(s.pending, err.Error())
+	s.Unlock()
+}
+
+func (s *scrapeStatus) done(start time.Time) {
+	s.Lock()
+	s.last, s.duration = start, time.Since(start)
+	s.errors, s.pending = s.pending, nil
+	s.Unlock()
+}
+
+func (c *Collector) Status() Status {
+	st := Status{Connection: connState(c.conn.Client().State())}
+	st.Connected = st.Connection == "connected"
+	if e := c.conn.Endpoint(); e != nil {
+		st.Endpoint = *e
+	}
+	mc := c.current.get()
+	st.Metrics = len(mc.opcuaMetricsCache) + len(mc.methodMetricsCache) + len(mc.computedMetricsCache) +
+		len(mc.aggregatedMetricsCache) + len(mc.edgeMetricsCache) + len(mc.stateMetricsCache)
+	c.status.Lock()
+	st.LastScrape, st.LastScrapeDuration = c.status.last, c.status.duration
+	st.LastScrapeErrors = append([]string(nil), c.status.errors...)
+	c.status.Unlock()
+	return st
+}
+
+func connState(s opcua.ConnState) string {
+	switch s {
+	case opcua.Connected:
+		return "connected"
+	case opcua.Connecting:
+		return "connecting"
+	case opcua.Disconnected:
+		return "disconnected"
+	case opcua.Reconnecting:
+		return "reconnecting"
+	default:
+		return "closed"
+	}
+}
@@ -0,0 +1,204 @@
+package collector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+const storeSaveInterval = 10 * time.Second
+
+// store keeps the values accumulated inside the exporter, such as counters
+// built from subscriptions, and persists them so restarts do not reset them.
+type store struct {
+	sync.Mutex
+	logger log.Logger
+	path   string
+	values map[string]float64
+	// gen counts the changes of values, saved is the last generation written
+	// to the state file
+	gen    uint64
+	saved  uint64
+	saving sync.Mutex
+	// done stops the periodic save, stopped is closed once it returned
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newStore(path string, l log.Logger) *store {
+	s := &store{logger: l, path: path, values: map[string]float64{}, done: make(chan struct{}), stopped: make(chan struct{})}
+	if path == "" {
+		close(s.stopped)
+		return s
+	}
+	content, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		l.Err("cannot read state file %s: %v", path, err)
+	default:
+		if err := json.Unmarshal(content, &s.values); err != nil {
+			l.Err("cannot parse state file %s: %v", path, err)
+		}
+	}
+	go s.run()
+	return s
+}
+
+func (s *store) get(key string) float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.values[key]
+}
+
+func (s *store) add(key string, delta float64) {
+	s.Lock()
+	s.values[key] += delta
+	s.gen++
+	s.Unlock()
+}
+
+func (s *store) run() {
+	defer close(s.stopped)
+	t := time.NewTicker(storeSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.save(); err != nil {
+				s.logger.Err("cannot save state file %s: %v", s.path, err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close stops the periodic save and saves the values a last time, so it must
+// be called after the last update.
+func (s *store) close() error {
+	close(s.done)
+	<-s.stopped
+	return s.save()
+}
+
+// save writes the values to the state file when they changed since the last
+// successful save, a failed save being retried on the next call.
+func (s *store) save() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	s.Lock()
+	if s.path == "" || s.gen == s.saved {
+		s.Unlock()
+		return nil
+	}
+	content, err := json.Marshal(s.values)
+	gen := s.gen
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.Lock()
+	s.saved = gen
+	s.Unlock()
+	return nil
+}
+
+// labelValues returns the values of label among the keys of the series name
+// whose other labels are labels.
+func (s *store) labelValues(name string, labels map[string]string, label string) []string {
+	s.Lock()
+	defer s.Unlock()
+	var values []string
+	for k := range s.values {
+		n, ll, ok := parseStoreKey(k)
+		if !ok || n != name || len(ll) != len(labels)+1 {
+			continue
+		}
+		v, ok := ll[label]
+		if !ok {
+			continue
+		}
+		match := true
+		for lk, lv := range labels {
+			if ll[lk] != lv {
+				match = false
+				break
+			}
+		}
+		if match {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// storeKeyEscaper escapes the characters delimiting the labels of a store
+// key in the label values.
+var storeKeyEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`, `}`, `\}`)
+
+// storeKey identifies a series in the store from its name and labels. The
+// label values are escaped, so keys of series without special characters in
+// their values are the same as before the escaping was introduced.
+func storeKey(name string, labels map[string]string) string {
+	var ll []string
+	for k, v := range labels {
+		ll = append(ll, k+"="+storeKeyEscaper.Replace(v))
+	}
+	sort.Strings(ll)
+	return name + "{" + strings.Join(ll, ",") + "}"
+}
+
+// parseStoreKey returns the name and labels of a key built by storeKey.
+func parseStoreKey(key string) (string, map[string]string, bool) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 || !strings.HasSuffix(key, "}") {
+		return "", nil, false
+	}
+	name, rest := key[:i], key[i+1:len(key)-1]
+	labels := map[string]string{}
+	for rest != "" {
+		j := strings.IndexByte(rest, '=')
+		if j < 0 {
+			return "", nil, false
+		}
+		k := rest[:j]
+		rest = rest[j+1:]
+		var v strings.Builder
+		for rest != "" && rest[0] != ',' {
+			if rest[0] == '\\' {
+				if len(rest) < 2 {
+					return "", nil, false
+				}
+				rest = rest[1:]
+			}
+			v.WriteByte(rest[0])
+			rest = rest[1:]
+		}
+		labels[k] = v.String()
+		rest = strings.TrimPrefix(rest, ",")
+	}
+	return name, labels, true
+}
@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestStoreKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "no labels", want: "m{}"},
+		{name: "plain values", labels: map[string]string{"b": "2", "a": "1"}, want: "m{a=1,b=2}"},
+		{name: "empty value", labels: map[string]string{"a": ""}, want: "m{a=}"},
+		{name: "comma", labels: map[string]string{"a": "1,b=2"}, want: `m{a=1\,b\=2}`},
+		{name: "brace", labels: map[string]string{"a": "x}"}, want: `m{a=x\}}`},
+		{name: "backslash", labels: map[string]string{"a": `x\`, "b": `\,`}, want: `m{a=x\\,b=\\\,}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := storeKey("m", tt.labels)
+			if key != tt.want {
+				t.Errorf("got key %s, want %s", key, tt.want)
+			}
+			name, labels, ok := parseStoreKey(key)
+			if !ok || name != "m" {
+				t.Fatalf("cannot parse key %s", key)
+			}
+			want := tt.labels
+			if want == nil {
+				want = map[string]string{}
+			}
+			if !reflect.DeepEqual(labels, want) {
+				t.Errorf("got labels %v, want %v", labels, want)
+			}
+		})
+	}
+}
+
+func TestStoreKeyCollisions(t *testing.T) {
+	// these label sets joined without escaping give the same key
+	a := storeKey("m", map[string]string{"a": "1,b=2"})
+	b := storeKey("m", map[string]string{"a": "1", "b": "2"})
+	if a == b {
+		t.Errorf("label sets share the key %s", a)
+	}
+}
+
+func TestStoreLabelValues(t *testing.T) {
+	s := newStore("", nopLogger{})
+	labels := map[string]string{"line": "a,b"}
+	s.add(storeKey("m", withLabel(labels, "state", "on")), 1)
+	s.add(storeKey("m", withLabel(labels, "state", "off=0")), 1)
+	// another series, more labels, another name
+	s.add(storeKey("m", withLabel(map[string]string{"line": "a"}, "state", "on")), 1)
+	s.add(storeKey("m", withLabel(withLabel(labels, "state", "on"), "x", "y")), 1)
+	s.add(storeKey("n", withLabel(labels, "state", "on")), 1)
+
+	got := s.labelValues("m", labels, "state")
+	sort.Strings(got)
+	if want := []string{"off=0", "on"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStoreClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := newStore(path, nopLogger{})
+	s.add("m{}", 2)
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values map[string]float64
+	if err := json.Unmarshal(content, &values); err != nil {
+		t.Fatal(err)
+	}
+	if values["m{}"] != 2 {
+		t.Errorf("got saved values %v", values)
+	}
+	restored := newStore(path, nopLogger{})
+	defer restored.close()
+	if restored.get("m{}") != 2 {
+		t.Error("the values were not restored")
+	}
+}
@@ -0,0 +1,223 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+const subscriptionInterval = time.Second
+
+// subscriber owns the OPCUA subscription shared by every feature relying on
+// notifications instead of reads. Monitored items are recreated when the
+// connection is replaced and reconnect hooks run once the session is back.
+type subscriber struct {
+	sync.Mutex
+	logger   log.Logger
+	conn     *connection
+	client   *opcua.Client
+	sub      *opcua.Subscription
+	notifyCh chan *opcua.PublishNotificationData
+	items    []*monitoredItem
+	hooks    []func(sub *opcua.Subscription)
+	dhooks   []func()
+	cancel   context.CancelFunc
+}
+
+type monitoredItem struct {
+	req         *ua.MonitoredItemCreateRequest
+	dataHandler func(*ua.DataValue)
+	evtHandler  func([]*ua.Variant)
+}
+
+func newSubscriber(conn *connection, l log.Logger) *subscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &subscriber{
+		logger:   l,
+		conn:     conn,
+		notifyCh: make(chan *opcua.PublishNotificationData, 64),
+		cancel:   cancel,
+	}
+	go s.run(ctx)
+	return s
+}
+
+func (s *subscriber) monitorValue(nodeID *ua.NodeID, samplingInterval time.Duration, h func(*ua.DataValue)) error {
+	s.Lock()
+	defer s.Unlock()
+	req := opcua.NewMonitoredItemCreateRequestWithDefaults(nodeID, ua.AttributeIDValue, uint32(len(s.items)+1))
+	req.RequestedParameters.SamplingInterval = float64(samplingInterval / time.Millisecond)
+	req.RequestedParameters.QueueSize = 1000
+	return s.add(&monitoredItem{req: req, dataHandler: h})
+}
+
+func (s *subscriber) monitorEvents(notifier *ua.NodeID, filter *ua.EventFilter, h func([]*ua.Variant)) error {
+	s.Lock()
+	defer s.Unlock()
+	req := &ua.MonitoredItemCreateRequest{
+		ItemToMonitor: &ua.ReadValueID{
+			NodeID:       notifier,
+			AttributeID:  ua.AttributeIDEventNotifier,
+			DataEncoding: &ua.QualifiedName{},
+		},
+		MonitoringMode: ua.MonitoringModeReporting,
+		RequestedParameters: &ua.MonitoringParameters{
+			ClientHandle:  uint32(len(s.items) + 1),
+			DiscardOldest: true,
+			Filter:        extensionObject(eventFilterEncoding, filter),
+			QueueSize:     1000,
+		},
+	}
+	return s.add(&monitoredItem{req: req, evtHandler: h})
+}
+
+// onReconnect registers a hook called with the subscription each time the
+// session is established again.
+func (s *subscriber) onReconnect(h func(sub *opcua.Subscription)) {
+	s.Lock()
+	s.hooks = append(s.hooks, h)
+	s.Unlock()
+}
+
+// onDisconnect registers a hook called each time the session is lost.
+func (s *subscriber) onDisconnect(h func()) {
+	s.Lock()
+	s.dhooks = append(s.dhooks, h)
+	s.Unlock()
+}
+
+func (s *subscriber) add(item *monitoredItem) error {
+	if err := s.subscribe(); err != nil {
+		return err
+	}
+	s.items = append(s.items, item)
+	return monitor(s.sub, item)
+}
+
+func (s *subscriber) subscribe() error {
+	cl := s.conn.Client()
+	if s.sub != nil && s.client == cl {
+		return nil
+	}
+	sub, err := cl.Subscribe(&opcua.SubscriptionParameters{Interval: subscriptionInterval}, s.notifyCh)
+	if err != nil {
+		return fmt.Errorf("cannot create subscription: %w", err)
+	}
+	s.sub, s.client = sub, cl
+	return nil
+}
+
+func monitor(sub *opcua.Subscription, item *monitoredItem) error {
+	res, err := sub.Monitor(ua.TimestampsToReturnBoth, item.req)
+	if err != nil {
+		return fmt.Errorf("cannot monitor node %s: %w", item.req.ItemToMonitor.NodeID, err)
+	}
+	if len(res.Results) != 1 {
+		return fmt.Errorf("cannot monitor node %s: expected 1 result, got %d", item.req.ItemToMonitor.NodeID, len(res.Results))
+	}
+	if res.Results[0].StatusCode != ua.StatusOK {
+		return fmt.Errorf("cannot monitor node %s: %v", item.req.ItemToMonitor.NodeID, res.Results[0].StatusCode)
+	}
+	return nil
+}
+
+// resubscribe recreates the subscription and its items on a new client.
+func (s *subscriber) resubscribe() {
+	s.Lock()
+	defer s.Unlock()
+	s.sub = nil
+	if err := s.subscribe(); err != nil {
+		s.logger.Err("%v", err)
+		return
+	}
+	for _, item := range s.items {
+		if err := monitor(s.sub, item); err != nil {
+			s.logger.Err("%v", err)
+		}
+	}
+}
+
+func (s *subscriber) close() {
+	s.cancel()
+	s.Lock()
+	defer s.Unlock()
+	if s.sub != nil {
+		if err := s.sub.Cancel(); err != nil {
+			s.logger.Warn("cannot delete subscription %d: %v", s.sub.SubscriptionID, err)
+		}
+		s.sub = nil
+	}
+}
+
+func (s *subscriber) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	connected := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Lock()
+			cl, sub, hooks, dhooks := s.client, s.sub, s.hooks, s.dhooks
+			s.Unlock()
+			if sub == nil {
+				continue
+			}
+			state := cl == s.conn.Client() && cl.State() == opcua.Connected
+			if !state && connected {
+				for _, h := range dhooks {
+					h()
+				}
+			}
+			if cl != s.conn.Client() {
+				s.resubscribe()
+				connected = false
+				continue
+			}
+			if state && !connected {
+				for _, h := range hooks {
+					h(sub)
+				}
+			}
+			connected = state
+		case n := <-s.notifyCh:
+			if n.Error != nil {
+				s.logger.Warn("subscription error: %v", n.Error)
+				continue
+			}
+			s.dispatch(n.Value)
+		}
+	}
+}
+
+func (s *subscriber) dispatch(v interface{}) {
+	s.Lock()
+	items := s.items
+	s.Unlock()
+	item := func(handle uint32) *monitoredItem {
+		if handle == 0 || int(handle) > len(items) {
+			return nil
+		}
+		return items[handle-1]
+	}
+	switch x := v.(type) {
+	case *ua.DataChangeNotification:
+		for _, n := range x.MonitoredItems {
+			if it := item(n.ClientHandle); it != nil && it.dataHandler != nil {
+				it.dataHandler(n.Value)
+			}
+		}
+	case *ua.EventNotificationList:
+		for _, e := range x.Events {
+			if it := item(e.ClientHandle); it != nil && it.evtHandler != nil {
+				it.evtHandler(e.EventFields)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// Variant converts the argument to the OPC UA type named by Type.
+func (a Argument) Variant() (*ua.Variant, error) {
+	var v interface{}
+	var err error
+	switch strings.ToLower(a.Type) {
+	case "boolean", "bool":
+		v, err = strconv.ParseBool(a.Value)
+	case "sbyte":
+		var i int64
+		i, err = strconv.ParseInt(a.Value, 10, 8)
+		v = int8(i)
+	case "byte":
+		var i uint64
+		i, err = strconv.ParseUint(a.Value, 10, 8)
+		v = uint8(i)
+	case "int16":
+		var i int64
+		i, err = strconv.ParseInt(a.Value, 10, 16)
+		v = int16(i)
+	case "uint16":
+		var i uint64
+		i, err = strconv.ParseUint(a.Value, 10, 16)
+		v = uint16(i)
+	case "int32":
+		var i int64
+		i, err = strconv.ParseInt(a.Value, 10, 32)
+		v = int32(i)
+	case "uint32":
+		var i uint64
+		i, err = strconv.ParseUint(a.Value, 10, 32)
+		v = uint32(i)
+	case "int64":
+		v, err = strconv.ParseInt(a.Value, 10, 64)
+	case "uint64":
+		v, err = strconv.ParseUint(a.Value, 10, 64)
+	case "float":
+		var f float64
+		f, err = strconv.ParseFloat(a.Value, 32)
+		v = float32(f)
+	case "double":
+		v, err = strconv.ParseFloat(a.Value, 64)
+	case "string":
+		v = a.Value
+	case "nodeid":
+		v, err = ua.ParseNodeID(a.Value)
+	default:
+		return nil, fmt.Errorf("unsupported argument type %s", a.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s argument %q: %v", a.Type, a.Value, err)
+	}
+	return ua.NewVariant(v)
+}
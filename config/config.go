@@ -1,12 +1,18 @@
 package config
 
 import (
-	"errors"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 
 	yaml "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 type Config struct {
@@ -15,40 +21,93 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	Endpoint  string
-	CertPath  string
-	KeyPath   string
+	Endpoint              string
+	CertPath              string
+	KeyPath               string
+	SecPolicy             string
+	SecMode               string
+	AuthMode              string
+	Username              string
+	Password              string
+	EndpointFallbacks     []EndpointSelection
+	RewriteEndpointHost   bool
+	DiscoveryURL          string
+	ApplicationURI        string
+	ReverseConnectAddress string
+	ServerURI             string
+}
+
+type EndpointSelection struct {
 	SecPolicy string
 	SecMode   string
 	AuthMode  string
-	Username  string
-	Password  string
 }
 
 type MetricsConfig struct {
-	Metrics []Metric `yaml:"metrics"`
+	Include   []string   `yaml:"include,omitempty"`
+	Metrics   []Metric   `yaml:"metrics"`
+	Templates []Template `yaml:"templates,omitempty"`
+	Events    []Event    `yaml:"events,omitempty"`
+
+	MetricRelabelConfigs []*RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
+
+	resolved    []Metric
+	hasResolved bool
+	relabeler   *Relabeler
+	sources     []source
+	watched     []string
+	fingerprint string
 }
 
 type Metric struct {
-	Name   string            `yaml:"name"`
-	Help   string            `yaml:"help"`
-	NodeID string            `yaml:"nodeid"`
-	Labels map[string]string `yaml:"labels"`
-	Type   string            `yaml:"type"`
+	Name      string            `yaml:"name" json:"name"`
+	Help      string            `yaml:"help" json:"help"`
+	NodeID    string            `yaml:"nodeid,omitempty" json:"nodeid,omitempty"`
+	Labels    map[string]string `yaml:"labels" json:"labels"`
+	Type      string            `yaml:"type" json:"type"`
+	Method    *Method           `yaml:"method,omitempty" json:"method,omitempty"`
+	Computed  string            `yaml:"computed,omitempty" json:"computed,omitempty"`
+	Aggregate *Aggregate        `yaml:"aggregate,omitempty" json:"aggregate,omitempty"`
+	Edge      string            `yaml:"edge,omitempty" json:"edge,omitempty"`
+	States    map[int64]string  `yaml:"states,omitempty" json:"states,omitempty"`
+
+	LabelNodes         map[string]string `yaml:"label_nodes,omitempty" json:"label_nodes,omitempty"`
+	LabelNodesInterval Duration          `yaml:"label_nodes_interval,omitempty" json:"label_nodes_interval,omitempty"`
+
+	pos *position
+}
+
+type Aggregate struct {
+	Mode             string    `yaml:"mode" json:"mode"`
+	Buckets          []float64 `yaml:"buckets,omitempty" json:"buckets,omitempty"`
+	SamplingInterval Duration  `yaml:"sampling_interval,omitempty" json:"sampling_interval,omitempty"`
+	Window           Duration  `yaml:"window,omitempty" json:"window,omitempty"`
+}
+
+type Method struct {
+	ObjectID string     `yaml:"objectid" json:"objectid"`
+	MethodID string     `yaml:"methodid" json:"methodid"`
+	Inputs   []Argument `yaml:"inputs,omitempty" json:"inputs,omitempty"`
+	Output   int        `yaml:"output" json:"output"`
+	Interval Duration   `yaml:"interval,omitempty" json:"interval,omitempty"`
+}
+
+type Argument struct {
+	Type  string `yaml:"type" json:"type"`
+	Value string `yaml:"value" json:"value"`
+}
+
+type Event struct {
+	Notifier    string   `yaml:"notifier"`
+	MinSeverity uint16   `yaml:"min_severity,omitempty"`
+	Types       []string `yaml:"types,omitempty"`
+
+	pos *position
 }
 
-func NewConfig(endpoint, certPath, keyPath, secMode, secPolicy, authMode, username, password, configPath string) (*Config, error) {
+func NewConfig(serverConfig *ServerConfig, configPath string) (*Config, error) {
 	c := &Config{
-		ServerConfig: &ServerConfig{
-			Endpoint:  endpoint,
-			CertPath:  certPath,
-			KeyPath:   keyPath,
-			SecMode:   secMode,
-			SecPolicy: secPolicy,
-			AuthMode:  authMode,
-			Username:  username,
-			Password:  password,
-		},
+		ServerConfig:  serverConfig,
 		MetricsConfig: &MetricsConfig{},
 	}
 	if err := c.LoadMetricsConfig(configPath); err != nil {
@@ -57,52 +116,156 @@ func NewConfig(endpoint, certPath, keyPath, secMode, secPolicy, authMode, userna
 	return c, nil
 }
 
+// LoadMetricsConfig reads filename, or every file of the directory filename,
+// along with the files they include.
 func (c *Config) LoadMetricsConfig(filename string) error {
-	content, err := ioutil.ReadFile(filename)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	// the current metrics config is only replaced by a valid one
+	mm, err := ReadMetricsConfig(filename)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") {
-			return nil
+		return err
+	}
+	if err := mm.validate(); err != nil {
+		return err
+	}
+	c.MetricsConfig = mm
+	return nil
+}
+
+// EndpointSelections returns the ordered list of acceptable (policy, mode, auth)
+// combinations, starting with the one given by SecPolicy, SecMode and AuthMode.
+func (sc ServerConfig) EndpointSelections() []EndpointSelection {
+	return append([]EndpointSelection{{SecPolicy: sc.SecPolicy, SecMode: sc.SecMode, AuthMode: sc.AuthMode}}, sc.EndpointFallbacks...)
+}
+
+// ParseEndpointSelections parses a comma separated list of policy:mode:auth triplets.
+func ParseEndpointSelections(s string) ([]EndpointSelection, error) {
+	var ss []EndpointSelection
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		// the policy may be a full URI containing ':' so mode and auth are taken from the end
+		parts := strings.Split(item, ":")
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("invalid endpoint selection %q, expected policy:mode:auth", item)
 		}
+		n := len(parts)
+		ss = append(ss, EndpointSelection{SecPolicy: strings.Join(parts[:n-2], ":"), SecMode: parts[n-2], AuthMode: parts[n-1]})
+	}
+	return ss, nil
+}
+
+// WriteFile replaces filename by content through a rename so that readers
+// never see a partially written file.
+func WriteFile(filename string, content []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
 		return err
 	}
-	if err = (c.MetricsConfig).Unserialize(content); err != nil {
+	if err := tmp.Close(); err != nil {
 		return err
 	}
-	if err := c.MetricsConfig.validate(); err != nil {
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
 		return err
 	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// ID identifies a metric by its name and labels.
+func (m Metric) ID() string {
+	sum := sha256.Sum256([]byte(seriesKey(m)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// AllMetrics returns the configured metrics followed by the ones expanded
+// from templates.
+func (mm *MetricsConfig) AllMetrics() []Metric {
+	if !mm.hasResolved {
+		return mm.Metrics
+	}
+	return mm.resolved
+}
+
+// Relabeler returns the compiled metric_relabel_configs, applied by the
+// collector to every series it exposes.
+func (mm *MetricsConfig) Relabeler() *Relabeler {
+	return mm.relabeler
+}
+
+// resolve expands the templates and compiles the relabeling rules. Invalid
+// rules are left to validate, which reports all of them.
+func (mm *MetricsConfig) resolve() error {
+	all := append([]Metric(nil), mm.Metrics...)
+	for i, t := range mm.Templates {
+		expanded, err := t.expand(i)
+		if err != nil {
+			return err
+		}
+		all = append(all, expanded...)
+	}
+	relabeler, _ := NewRelabeler(mm.MetricRelabelConfigs)
+	mm.resolved, mm.hasResolved, mm.relabeler = all, true, relabeler
 	return nil
 }
 
-func WriteFile(filename string, content []byte) error {
-	if err := ioutil.WriteFile(filename, content, 0644); err != nil {
+func (mm *MetricsConfig) Unserialize(content []byte) error {
+	*mm = MetricsConfig{}
+	if err := singleDocument(content); err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(content, mm); err != nil {
 		return err
 	}
+	mm.locate(content)
 	return nil
 }
 
-func (mm MetricsConfig) validate() error {
-	for i, m := range mm.Metrics {
-		if m.Name == "" {
-			return errors.New("missing field 'name' in 'metrics' configuration of metric " + fmt.Sprint(i))
+// singleDocument rejects content holding several YAML documents, such as the
+// output of Serialize for a config split across files, of which yaml.Unmarshal
+// would silently keep the first one.
+func singleDocument(content []byte) error {
+	dec := yamlv3.NewDecoder(bytes.NewReader(content))
+	found := false
+	for {
+		var doc yamlv3.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return nil
 		}
-		if m.Help == "" {
-			return errors.New("missing field 'help' in 'metrics' configuration of metric " + fmt.Sprint(i))
+		if err != nil {
+			// reported by yaml.Unmarshal
+			return nil
 		}
-		if m.NodeID == "" {
-			return errors.New("missing field 'nodeValue' in 'metrics' configuration of metric " + fmt.Sprint(i))
+		if len(doc.Content) == 0 {
+			continue
 		}
-		if m.Type == "" {
-			return errors.New("missing field 'type' in 'metrics' configuration of metric " + fmt.Sprint(i))
+		if found {
+			return fmt.Errorf("line %d: a single YAML document is expected, a config split across files is updated file by file", doc.Line)
 		}
+		found = true
 	}
-	return nil
-}
-
-func (mm *MetricsConfig) Unserialize(content []byte) error {
-	return yaml.Unmarshal(content, mm)
 }
 
 func (cfg *MetricsConfig) Serialize() ([]byte, error) {
+	if len(cfg.sources) > 0 {
+		return cfg.serializeSources()
+	}
 	return yaml.Marshal(cfg)
 }
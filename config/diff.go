@@ -0,0 +1,230 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+// edit is a line of a diff, kept (' '), removed ('-') or added ('+'), with
+// its index in a and b.
+type edit struct {
+	op   byte
+	line string
+	a, b int
+}
+
+// unifiedDiff returns the differences between a and b in unified format,
+// computed from the longest common subsequence of their lines.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	edits := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		// a hunk spans the changes separated by at most 2*diffContext lines
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for n := k; n < len(edits); n++ {
+			if edits[n].op != ' ' {
+				end = n
+			} else if n-end > 2*diffContext {
+				break
+			}
+		}
+		end += diffContext + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		var countA, countB int
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(edits[start].a, countA), hunkRange(edits[start].b, countB))
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+		k = end
+	}
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		// as diff, a range of one line is its number alone
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// noNewline marks the last line of a content without a final newline, so it
+// differs from the same line followed by one and is printed as diff does.
+const noNewline = "\n\\ No newline at end of file"
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if !strings.HasSuffix(s, "\n") {
+		lines[len(lines)-1] += noNewline
+	}
+	return lines
+}
+
+// diffLines returns the edits turning la into lb. The common prefix and
+// suffix are skipped and the rest is compared in linear space, with the
+// removals of each change put before its additions.
+func diffLines(la, lb []string) []edit {
+	prefix := 0
+	for prefix < len(la) && prefix < len(lb) && la[prefix] == lb[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(la)-prefix && suffix < len(lb)-prefix && la[len(la)-1-suffix] == lb[len(lb)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]edit, 0, len(la)+len(lb)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, edit{' ', la[i], i, i})
+	}
+	d := &differ{la: la, lb: lb}
+	d.diff(prefix, len(la)-suffix, prefix, len(lb)-suffix)
+	edits = append(edits, groupChanges(d.edits)...)
+	for k := 0; k < suffix; k++ {
+		i, j := len(la)-suffix+k, len(lb)-suffix+k
+		edits = append(edits, edit{' ', la[i], i, j})
+	}
+	return edits
+}
+
+// differ computes the edits between la and lb with Hirschberg's algorithm,
+// which splits the problem on the middle line of a using the last row of the
+// LCS lengths computed forward and backward.
+type differ struct {
+	la, lb []string
+	edits  []edit
+}
+
+// diff appends the edits turning la[a0:a1] into lb[b0:b1].
+func (d *differ) diff(a0, a1, b0, b1 int) {
+	switch {
+	case a0 == a1:
+		for j := b0; j < b1; j++ {
+			d.edits = append(d.edits, edit{'+', d.lb[j], a0, j})
+		}
+		return
+	case b0 == b1:
+		for i := a0; i < a1; i++ {
+			d.edits = append(d.edits, edit{'-', d.la[i], i, b0})
+		}
+		return
+	case a1-a0 == 1:
+		for j := b0; j < b1; j++ {
+			if d.la[a0] == d.lb[j] {
+				d.diff(a0, a0, b0, j)
+				d.edits = append(d.edits, edit{' ', d.la[a0], a0, j})
+				d.diff(a1, a1, j+1, b1)
+				return
+			}
+		}
+		d.edits = append(d.edits, edit{'-', d.la[a0], a0, b0})
+		d.diff(a1, a1, b0, b1)
+		return
+	}
+
+	mid := (a0 + a1) / 2
+	forward := d.lcsLengths(a0, mid, b0, b1, false)
+	backward := d.lcsLengths(mid, a1, b0, b1, true)
+	split, best := b0, -1
+	for k := 0; k <= b1-b0; k++ {
+		if l := forward[k] + backward[b1-b0-k]; l > best {
+			split, best = b0+k, l
+		}
+	}
+	d.diff(a0, mid, b0, split)
+	d.diff(mid, a1, split, b1)
+}
+
+// lcsLengths returns, for each k, the length of the longest common
+// subsequence of la[a0:a1] and the first k lines of lb[b0:b1], or its last k
+// lines when reverse is set.
+func (d *differ) lcsLengths(a0, a1, b0, b1 int, reverse bool) []int {
+	n := b1 - b0
+	prev, cur := make([]int, n+1), make([]int, n+1)
+	for i := 0; i < a1-a0; i++ {
+		la := d.la[a0+i]
+		if reverse {
+			la = d.la[a1-1-i]
+		}
+		for k := 1; k <= n; k++ {
+			lb := d.lb[b0+k-1]
+			if reverse {
+				lb = d.lb[b1-k]
+			}
+			switch {
+			case la == lb:
+				cur[k] = prev[k-1] + 1
+			case prev[k] >= cur[k-1]:
+				cur[k] = prev[k]
+			default:
+				cur[k] = cur[k-1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+// groupChanges moves the removals of each run of changes before its
+// additions.
+func groupChanges(edits []edit) []edit {
+	out := make([]edit, 0, len(edits))
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			out = append(out, edits[k])
+			k++
+			continue
+		}
+		end := k
+		for end < len(edits) && edits[end].op != ' ' {
+			end++
+		}
+		// the run starts at the same position of a and b whatever its order
+		a, b := edits[k].a, edits[k].b
+		for _, op := range []byte{'-', '+'} {
+			for _, e := range edits[k:end] {
+				if e.op == op {
+					e.a, e.b = a, b
+					out = append(out, e)
+					if op == '-' {
+						a++
+					} else {
+						b++
+					}
+				}
+			}
+		}
+		k = end
+	}
+	return out
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "identical",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "from empty",
+			a:    "",
+			b:    "a\nb\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "to empty",
+			a:    "a\nb\n",
+			b:    "",
+			want: "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name: "changed line with context",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:    "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			want: "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "removals before additions",
+			a:    "x\na\nb\ny\n",
+			b:    "x\nc\nd\ny\n",
+			want: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n x\n-a\n-b\n+c\n+d\n y\n",
+		},
+		{
+			name: "added at the start",
+			a:    "b\nc\n",
+			b:    "a\nb\nc\n",
+			want: "--- a\n+++ b\n@@ -1,2 +1,3 @@\n+a\n b\n c\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			want: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+		{
+			name: "both empty",
+			a:    "",
+			b:    "",
+			want: "",
+		},
+		{
+			name: "from empty without final newline",
+			a:    "",
+			b:    "a",
+			want: "--- a\n+++ b\n@@ -0,0 +1 @@\n+a\n\\ No newline at end of file\n",
+		},
+		{
+			name: "final newline added",
+			a:    "a\nb",
+			b:    "a\nb\n",
+			want: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "final newline removed",
+			a:    "a\nb\n",
+			b:    "a\nb",
+			want: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			name: "both without final newline",
+			a:    "a\nb",
+			b:    "a\nc",
+			want: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+		{
+			name: "unchanged last line without final newline",
+			a:    "a\nb",
+			b:    "x\nb",
+			want: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-a\n+x\n b\n\\ No newline at end of file\n",
+		},
+		{
+			name: "empty lines",
+			a:    "\n\n\n",
+			b:    "\n\n",
+			want: "--- a\n+++ b\n@@ -1,3 +1,2 @@\n \n \n-\n",
+		},
+		{
+			name: "changes closer than twice the context share a hunk",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			b:    "1\n2\n3\nfour\n5\n6\n7\neight\n9\n10\n",
+			want: "--- a\n+++ b\n@@ -1,10 +1,10 @@\n 1\n 2\n 3\n-4\n+four\n 5\n 6\n 7\n-8\n+eight\n 9\n 10\n",
+		},
+		{
+			name: "changes one line further than twice the context",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\nnine\n",
+			want: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -6,4 +6,4 @@\n 6\n 7\n 8\n-9\n+nine\n",
+		},
+		{
+			name: "removed at the end",
+			a:    "1\n2\n3\n4\n5\n",
+			b:    "1\n2\n3\n4\n",
+			want: "--- a\n+++ b\n@@ -2,4 +2,3 @@\n 2\n 3\n 4\n-5\n",
+		},
+		{
+			name: "close changes share a hunk",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:    "one\n2\n3\n4\n5\n6\n7\neight\n",
+			want: "--- a\n+++ b\n@@ -1,8 +1,8 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("a", "b", tt.a, tt.b); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLinesMinimal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = strconv.Itoa(r.Intn(4))
+		}
+		return lines
+	}
+	for n := 0; n < 200; n++ {
+		la, lb := random(r.Intn(12)), random(r.Intn(12))
+		edits := diffLines(la, lb)
+
+		var gotA, gotB []string
+		kept := 0
+		for _, e := range edits {
+			if e.op != '+' {
+				gotA = append(gotA, e.line)
+			}
+			if e.op != '-' {
+				gotB = append(gotB, e.line)
+			}
+			if e.op == ' ' {
+				kept++
+			}
+		}
+		if strings.Join(gotA, ",") != strings.Join(la, ",") || strings.Join(gotB, ",") != strings.Join(lb, ",") {
+			t.Fatalf("edits of %v to %v do not rebuild them: %v", la, lb, edits)
+		}
+		if want := lcsLength(la, lb); kept != want {
+			t.Fatalf("edits of %v to %v keep %d lines, want %d", la, lb, kept, want)
+		}
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&a, "line %d\n", i)
+		if i == 25000 {
+			b.WriteString("changed\n")
+			continue
+		}
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	want := "--- a\n+++ b\n@@ -24998,7 +24998,7 @@\n line 24997\n line 24998\n line 24999\n-line 25000\n+changed\n line 25001\n line 25002\n line 25003\n"
+	if got := unifiedDiff("a", "b", a.String(), b.String()); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// lcsLength is the quadratic reference for the length of the longest common
+// subsequence of a and b.
+func lcsLength(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
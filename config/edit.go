@@ -0,0 +1,125 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// MetricEntry is a metric along with the file declaring it.
+type MetricEntry struct {
+	Metric
+	File string
+	// Index is the position of the metric in the metrics of File, -1 for a
+	// metric expanded from a template.
+	Index int
+}
+
+// ReadMetricsConfig reads path like LoadMetricsConfig, expanding the
+// templates but without validating the result.
+func ReadMetricsConfig(path string) (*MetricsConfig, error) {
+	mm, err := loadMetricsFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := mm.resolve(); err != nil {
+		return nil, err
+	}
+	return mm, nil
+}
+
+// Entries returns every metric of the config, the ones expanded from
+// templates last, with the file declaring them.
+func (mm *MetricsConfig) Entries() []MetricEntry {
+	var entries []MetricEntry
+	for _, src := range mm.sources {
+		for i, m := range src.cfg.Metrics {
+			entries = append(entries, MetricEntry{Metric: m, File: src.file, Index: i})
+		}
+	}
+	for _, m := range mm.AllMetrics()[len(mm.Metrics):] {
+		entries = append(entries, MetricEntry{Metric: m, File: m.pos.filename(), Index: -1})
+	}
+	return entries
+}
+
+// EditMetric returns content, a metrics config file, with the metric at
+// index of its metrics replaced by m, removed when m is nil, or with m
+// appended when index is -1. The rest of the file, comments included, is
+// kept.
+func EditMetric(content []byte, index int, m *Metric) ([]byte, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc = yamlv3.Node{Kind: yamlv3.DocumentNode, Content: []*yamlv3.Node{{Kind: yamlv3.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yamlv3.MappingNode {
+		return nil, fmt.Errorf("line %d: the config is not a mapping", root.Line)
+	}
+	seq := mappingValue(root, "metrics")
+	if seq == nil {
+		seq = &yamlv3.Node{Kind: yamlv3.SequenceNode, Tag: "!!seq"}
+		root.Content = append(root.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: "metrics"}, seq)
+	}
+	switch {
+	case seq.Kind == yamlv3.ScalarNode && seq.Tag == "!!null":
+		// an empty "metrics:"
+		seq.Kind, seq.Tag, seq.Value = yamlv3.SequenceNode, "!!seq", ""
+	case seq.Kind != yamlv3.SequenceNode:
+		return nil, fmt.Errorf("line %d: field 'metrics' is not a list", seq.Line)
+	}
+	if index < -1 || index >= len(seq.Content) {
+		return nil, fmt.Errorf("no metric %d in the config", index)
+	}
+
+	var n *yamlv3.Node
+	if m != nil {
+		n = &yamlv3.Node{}
+		if err := n.Encode(m); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case n == nil:
+		seq.Content = append(seq.Content[:index], seq.Content[index+1:]...)
+	case index == -1:
+		// "metrics: []" would otherwise stay on a single line
+		seq.Style = 0
+		seq.Content = append(seq.Content, n)
+	default:
+		keepComments(seq.Content[index], n)
+		seq.Content[index] = n
+	}
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// keepComments copies the comments of old to n, and those of the fields of
+// old to the same fields of n.
+func keepComments(old, n *yamlv3.Node) {
+	n.HeadComment, n.LineComment, n.FootComment = old.HeadComment, old.LineComment, old.FootComment
+	if old.Kind != yamlv3.MappingNode || n.Kind != yamlv3.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(old.Content); i += 2 {
+		for j := 0; j+1 < len(n.Content); j += 2 {
+			if n.Content[j].Value == old.Content[i].Value {
+				keepComments(old.Content[i], n.Content[j])
+				keepComments(old.Content[i+1], n.Content[j+1])
+			}
+		}
+	}
+}
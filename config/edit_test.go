@@ -0,0 +1,118 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEditMetric(t *testing.T) {
+	const content = `# metrics of line 1
+metrics:
+  # temperature of the oven
+  - name: temperature # celsius
+    help: temperature
+    nodeid: ns=2;i=1
+    type: gauge
+  - name: pressure
+    help: pressure
+    nodeid: ns=2;i=2
+    type: gauge
+`
+	metric := &Metric{Name: "temperature", Help: "oven temperature", NodeID: "ns=2;i=1", Type: "gauge",
+		Aggregate: &Aggregate{Mode: "minmaxavg", Window: Duration(60e9)}}
+	tests := []struct {
+		name    string
+		content string
+		index   int
+		metric  *Metric
+		want    string
+		err     string
+	}{
+		{
+			name:    "replace keeps comments",
+			content: content,
+			index:   0,
+			metric:  metric,
+			want: `# metrics of line 1
+metrics:
+  # temperature of the oven
+  - name: temperature # celsius
+    help: oven temperature
+    nodeid: ns=2;i=1
+    labels: {}
+    type: gauge
+    aggregate:
+      mode: minmaxavg
+      window: 1m0s
+  - name: pressure
+    help: pressure
+    nodeid: ns=2;i=2
+    type: gauge
+`,
+		},
+		{
+			name:    "delete",
+			content: content,
+			index:   1,
+			want: `# metrics of line 1
+metrics:
+  # temperature of the oven
+  - name: temperature # celsius
+    help: temperature
+    nodeid: ns=2;i=1
+    type: gauge
+`,
+		},
+		{
+			name:    "append to an empty list",
+			content: "metrics: []\n",
+			index:   -1,
+			metric:  &Metric{Name: "a", Help: "a", NodeID: "ns=2;i=1", Type: "gauge"},
+			want:    "metrics:\n  - name: a\n    help: a\n    nodeid: ns=2;i=1\n    labels: {}\n    type: gauge\n",
+		},
+		{
+			name:    "append to an empty file",
+			content: "",
+			index:   -1,
+			metric:  &Metric{Name: "a", Help: "a", NodeID: "ns=2;i=1", Type: "gauge"},
+			want:    "metrics:\n  - name: a\n    help: a\n    nodeid: ns=2;i=1\n    labels: {}\n    type: gauge\n",
+		},
+		{
+			name:    "append without metrics",
+			content: "include: [more.yaml]\n",
+			index:   -1,
+			metric:  &Metric{Name: "a", Help: "a", NodeID: "ns=2;i=1", Type: "gauge"},
+			want:    "include: [more.yaml]\nmetrics:\n  - name: a\n    help: a\n    nodeid: ns=2;i=1\n    labels: {}\n    type: gauge\n",
+		},
+		{
+			name:    "out of range",
+			content: content,
+			index:   2,
+			err:     "no metric 2",
+		},
+		{
+			name:    "metrics is not a list",
+			content: "metrics: 1\n",
+			index:   -1,
+			metric:  metric,
+			err:     "field 'metrics' is not a list",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EditMetric([]byte(tt.content), tt.index, tt.metric)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Revision describes a configuration accepted by the exporter.
+type Revision struct {
+	Number     int       `json:"revision"`
+	Timestamp  time.Time `json:"timestamp"`
+	Client     string    `json:"client"`
+	RollbackOf int       `json:"rollback_of,omitempty"`
+
+	content []byte
+}
+
+// History keeps the last accepted configurations, in memory or, when dir is
+// set, as one file per revision along with an index.
+type History struct {
+	sync.Mutex
+	dir       string
+	limit     int
+	revisions []*Revision
+}
+
+const historyIndex = "history.json"
+
+// OpenHistory loads the revisions stored in dir. At most limit revisions are
+// kept, 0 meaning no limit.
+func OpenHistory(dir string, limit int) (*History, error) {
+	h := &History{dir: dir, limit: limit}
+	if dir == "" {
+		return h, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	index, err := ioutil.ReadFile(filepath.Join(dir, historyIndex))
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(index, &h.revisions); err != nil {
+		return nil, fmt.Errorf("invalid history index: %v", err)
+	}
+	for _, r := range h.revisions {
+		if r.content, err = ioutil.ReadFile(h.revisionFile(r.Number)); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *History) revisionFile(n int) string {
+	return filepath.Join(h.dir, fmt.Sprintf("revision-%06d.yaml", n))
+}
+
+// Add records content as a new revision, unless it is identical to the
+// latest one and rollbackOf is 0.
+func (h *History) Add(content []byte, client string, rollbackOf int) (*Revision, error) {
+	h.Lock()
+	defer h.Unlock()
+	n := 1
+	if len(h.revisions) > 0 {
+		last := h.revisions[len(h.revisions)-1]
+		if rollbackOf == 0 && bytes.Equal(last.content, content) {
+			return last, nil
+		}
+		n = last.Number + 1
+	}
+	r := &Revision{Number: n, Timestamp: time.Now().UTC(), Client: client, RollbackOf: rollbackOf, content: content}
+	if h.dir != "" {
+		if err := WriteFile(h.revisionFile(n), content); err != nil {
+			return nil, err
+		}
+	}
+	revisions := append(h.revisions, r)
+	var pruned []*Revision
+	if h.limit > 0 && len(revisions) > h.limit {
+		pruned = revisions[:len(revisions)-h.limit]
+		revisions = revisions[len(revisions)-h.limit:]
+	}
+	if h.dir != "" {
+		index, err := json.Marshal(revisions)
+		if err != nil {
+			return nil, err
+		}
+		if err := WriteFile(filepath.Join(h.dir, historyIndex), index); err != nil {
+			return nil, err
+		}
+		for _, p := range pruned {
+			os.Remove(h.revisionFile(p.Number))
+		}
+	}
+	h.revisions = revisions
+	return r, nil
+}
+
+// List returns the stored revisions, oldest first.
+func (h *History) List() []Revision {
+	h.Lock()
+	defer h.Unlock()
+	var rr []Revision
+	for _, r := range h.revisions {
+		rr = append(rr, *r)
+	}
+	return rr
+}
+
+// Latest returns the number of the latest revision, 0 if there is none.
+func (h *History) Latest() int {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.revisions) == 0 {
+		return 0
+	}
+	return h.revisions[len(h.revisions)-1].Number
+}
+
+// Content returns the configuration stored in revision n.
+func (h *History) Content(n int) ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+	for _, r := range h.revisions {
+		if r.Number == n {
+			return r.content, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown revision %d", n)
+}
+
+// Diff returns a unified diff between revisions from and to.
+func (h *History) Diff(from, to int) (string, error) {
+	a, err := h.Content(from)
+	if err != nil {
+		return "", err
+	}
+	b, err := h.Content(to)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(fmt.Sprintf("revision %d", from), fmt.Sprintf("revision %d", to), string(a), string(b)), nil
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryAdd(t *testing.T) {
+	type add struct {
+		content    string
+		rollbackOf int
+	}
+	tests := []struct {
+		name    string
+		limit   int
+		adds    []add
+		want    []int
+		content map[int]string
+	}{
+		{
+			name:    "numbered in order",
+			adds:    []add{{"a", 0}, {"b", 0}, {"c", 0}},
+			want:    []int{1, 2, 3},
+			content: map[int]string{1: "a", 3: "c"},
+		},
+		{
+			name: "identical content is recorded once",
+			adds: []add{{"a", 0}, {"a", 0}, {"b", 0}, {"b", 0}},
+			want: []int{1, 2},
+		},
+		{
+			name:    "rollback is always recorded",
+			adds:    []add{{"a", 0}, {"b", 0}, {"b", 2}},
+			want:    []int{1, 2, 3},
+			content: map[int]string{3: "b"},
+		},
+		{
+			name:    "oldest revisions are pruned",
+			limit:   2,
+			adds:    []add{{"a", 0}, {"b", 0}, {"c", 0}, {"d", 0}},
+			want:    []int{3, 4},
+			content: map[int]string{3: "c", 4: "d"},
+		},
+	}
+	for _, tt := range tests {
+		for _, dir := range []string{"", t.TempDir()} {
+			name := tt.name + " in memory"
+			if dir != "" {
+				name = tt.name + " on disk"
+			}
+			t.Run(name, func(t *testing.T) {
+				h, err := OpenHistory(dir, tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, a := range tt.adds {
+					if _, err := h.Add([]byte(a.content), "test", a.rollbackOf); err != nil {
+						t.Fatal(err)
+					}
+				}
+				checkRevisions(t, h, tt.want, tt.content)
+				if dir == "" {
+					return
+				}
+				reopened, err := OpenHistory(dir, tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkRevisions(t, reopened, tt.want, tt.content)
+				files, _ := filepath.Glob(filepath.Join(dir, "revision-*.yaml"))
+				if len(files) != len(tt.want) {
+					t.Errorf("got %d revision files, want %d", len(files), len(tt.want))
+				}
+			})
+		}
+	}
+}
+
+func checkRevisions(t *testing.T, h *History, want []int, content map[int]string) {
+	t.Helper()
+	revisions := h.List()
+	if len(revisions) != len(want) {
+		t.Fatalf("got %d revisions, want %d", len(revisions), len(want))
+	}
+	for i, r := range revisions {
+		if r.Number != want[i] {
+			t.Errorf("revision %d: got number %d, want %d", i, r.Number, want[i])
+		}
+	}
+	if h.Latest() != want[len(want)-1] {
+		t.Errorf("got latest %d, want %d", h.Latest(), want[len(want)-1])
+	}
+	for n, c := range content {
+		got, err := h.Content(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c {
+			t.Errorf("revision %d: got content %q, want %q", n, got, c)
+		}
+	}
+}
+
+func TestHistoryDiff(t *testing.T) {
+	h, _ := OpenHistory("", 0)
+	h.Add([]byte("metrics:\n- name: a\n"), "test", 0)
+	h.Add([]byte("metrics:\n- name: b\n"), "test", 0)
+
+	tests := []struct {
+		name     string
+		from, to int
+		want     string
+		err      string
+	}{
+		{name: "revisions", from: 1, to: 2, want: "--- revision 1\n+++ revision 2\n@@ -1,2 +1,2 @@\n metrics:\n-- name: a\n+- name: b\n"},
+		{name: "same revision", from: 2, to: 2, want: ""},
+		{name: "unknown revision", from: 1, to: 3, err: "unknown revision 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.Diff(tt.from, tt.to)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenHistoryInvalidIndex(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, historyIndex), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenHistory(dir, 0); err == nil {
+		t.Fatal("expected an error for an invalid index")
+	}
+	os.Remove(filepath.Join(dir, historyIndex))
+	if _, err := OpenHistory(dir, 0); err != nil {
+		t.Fatalf("unexpected error without index: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// source is the part of the metrics config read from one file.
+type source struct {
+	file string
+	cfg  *MetricsConfig
+}
+
+// loader reads a config file or directory and the files it includes into a
+// single metrics config.
+type loader struct {
+	merged  *MetricsConfig
+	seen    map[string]bool
+	watched []string
+	hash    hash.Hash
+}
+
+func loadMetricsFiles(path string) (*MetricsConfig, error) {
+	l := &loader{merged: &MetricsConfig{}, seen: map[string]bool{}, hash: sha256.New()}
+	if err := l.load(path); err != nil {
+		return nil, err
+	}
+	l.merged.watched = l.watched
+	l.merged.fingerprint = hex.EncodeToString(l.hash.Sum(nil))
+	return l.merged, nil
+}
+
+// Fingerprint returns the fingerprint of the files path currently reads,
+// without validating them.
+func Fingerprint(path string) (string, error) {
+	mm, err := loadMetricsFiles(path)
+	if err != nil {
+		return "", err
+	}
+	return mm.fingerprint, nil
+}
+
+// load reads path, which is either a file or a directory whose *.yaml and
+// *.yml files are read in lexical order.
+func (l *loader) load(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return l.loadFile(path)
+	}
+	l.watched = append(l.watched, path)
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		if err := l.loadFile(filepath.Join(path, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *loader) loadFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	// a file matched by several includes, or including itself, is read once
+	if l.seen[abs] {
+		return nil
+	}
+	l.seen[abs] = true
+	l.watched = append(l.watched, path)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(l.hash, "%s\x00%d\x00", path, len(content))
+	l.hash.Write(content)
+	part := &MetricsConfig{}
+	if err := part.Unserialize(content); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	part.setFile(path)
+	l.merged.merge(part)
+	l.merged.sources = append(l.merged.sources, source{file: path, cfg: part})
+
+	dir := filepath.Dir(path)
+	for _, pattern := range part.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid include %q: %v", path, pattern, err)
+		}
+		if !hasMeta(pattern) && len(matches) == 0 {
+			return fmt.Errorf("%s: included file %s does not exist", path, pattern)
+		}
+		// new files matching the pattern are noticed by watching its directory
+		l.watched = append(l.watched, filepath.Dir(pattern))
+		sort.Strings(matches)
+		for _, m := range matches {
+			if err := l.load(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+func (mm *MetricsConfig) setFile(file string) {
+	set := func(p **position) {
+		if *p == nil {
+			*p = &position{}
+		}
+		(*p).file = file
+	}
+	for i := range mm.Metrics {
+		set(&mm.Metrics[i].pos)
+	}
+	for i := range mm.Templates {
+		set(&mm.Templates[i].pos)
+		set(&mm.Templates[i].Metric.pos)
+	}
+	for i := range mm.Events {
+		set(&mm.Events[i].pos)
+	}
+	for _, rc := range mm.MetricRelabelConfigs {
+		if rc != nil {
+			set(&rc.pos)
+		}
+	}
+}
+
+func (mm *MetricsConfig) merge(part *MetricsConfig) {
+	if mm.sources == nil {
+		mm.Include = part.Include
+	}
+	mm.Metrics = append(mm.Metrics, part.Metrics...)
+	mm.Templates = append(mm.Templates, part.Templates...)
+	mm.Events = append(mm.Events, part.Events...)
+	mm.MetricRelabelConfigs = append(mm.MetricRelabelConfigs, part.MetricRelabelConfigs...)
+}
+
+// WatchPaths returns the files the config was read from and the directories
+// where new files would be picked up by a reload.
+func (mm *MetricsConfig) WatchPaths() []string {
+	return mm.watched
+}
+
+// Fingerprint identifies the content of the files the config was read from,
+// it is empty for a config that was not read from files.
+func (mm *MetricsConfig) Fingerprint() string {
+	if mm == nil {
+		return ""
+	}
+	return mm.fingerprint
+}
+
+// serializeSources writes one YAML document per source file, each preceded
+// by a comment naming the file.
+func (mm *MetricsConfig) serializeSources() ([]byte, error) {
+	var buf bytes.Buffer
+	for i, src := range mm.sources {
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		content, err := yaml.Marshal(src.cfg)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "# source: %s\n", src.file)
+		buf.Write(content)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const metricNameLabel = "__name__"
+
+// RelabelConfig follows the Prometheus metric_relabel_configs semantics, the
+// metric name is available as the __name__ label.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  *string  `yaml:"replacement,omitempty"`
+	Action       string   `yaml:"action,omitempty"`
+
+	pos *position
+}
+
+// Relabeler applies relabeling rules to the series exposed by the collector,
+// a nil Relabeler keeps them unchanged.
+type Relabeler struct {
+	rules []relabelRule
+}
+
+// relabelRule is a RelabelConfig with its defaults applied, leaving the
+// configuration as written.
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// errorf reports an error of the rule i at field.
+func (rc *RelabelConfig) errorf(i int, field string, format string, args ...interface{}) error {
+	line, column := rc.pos.of(field)
+	return ValidationError{File: rc.pos.filename(), Line: line, Column: column, Msg: fmt.Sprintf("invalid metric_relabel_configs %d: ", i) + fmt.Sprintf(format, args...)}
+}
+
+func (rc *RelabelConfig) compile(i int) (relabelRule, error) {
+	r := relabelRule{
+		sourceLabels: rc.SourceLabels,
+		separator:    rc.Separator,
+		targetLabel:  rc.TargetLabel,
+		replacement:  "$1",
+		action:       rc.Action,
+	}
+	if r.action == "" {
+		r.action = "replace"
+	}
+	if r.separator == "" {
+		r.separator = ";"
+	}
+	if rc.Replacement != nil {
+		r.replacement = *rc.Replacement
+	}
+	regex := rc.Regex
+	switch r.action {
+	case "replace", "lowercase":
+		if rc.TargetLabel == "" {
+			return r, rc.errorf(i, "action", "missing field 'target_label' for action %s", r.action)
+		}
+		// a target with references is checked once expanded, on the series
+		if !strings.Contains(rc.TargetLabel, "$") && rc.TargetLabel != metricNameLabel && !labelNameRE.MatchString(rc.TargetLabel) {
+			return r, rc.errorf(i, "target_label", "invalid target_label %q", rc.TargetLabel)
+		}
+	case "labelmap", "labeldrop", "labelkeep":
+		if regex == "" {
+			return r, rc.errorf(i, "action", "missing field 'regex' for action %s", r.action)
+		}
+	case "keep", "drop":
+	default:
+		return r, rc.errorf(i, "action", "unknown relabel action %s", r.action)
+	}
+	if regex == "" {
+		regex = "(.*)"
+	}
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return r, rc.errorf(i, "regex", "invalid regex %q: %v", rc.Regex, err)
+	}
+	r.regex = re
+	return r, nil
+}
+
+// NewRelabeler compiles rules, it returns nil without rules.
+func NewRelabeler(rules []*RelabelConfig) (*Relabeler, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &Relabeler{}
+	for i, rc := range rules {
+		if rc == nil {
+			continue
+		}
+		rule, err := rc.compile(i)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// Process applies the rules to a series, it returns false when the series is
+// dropped. labels is left unchanged.
+func (r *Relabeler) Process(name string, labels map[string]string) (string, map[string]string, bool) {
+	if r == nil {
+		return name, labels, true
+	}
+	ll := map[string]string{metricNameLabel: name}
+	for k, v := range labels {
+		ll[k] = v
+	}
+
+	for _, rule := range r.rules {
+		var values []string
+		for _, l := range rule.sourceLabels {
+			values = append(values, ll[l])
+		}
+		value := strings.Join(values, rule.separator)
+
+		switch rule.action {
+		case "keep":
+			if !rule.regex.MatchString(value) {
+				return "", nil, false
+			}
+		case "drop":
+			if rule.regex.MatchString(value) {
+				return "", nil, false
+			}
+		case "replace":
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, match))
+			res := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+			if res == "" {
+				delete(ll, target)
+				continue
+			}
+			ll[target] = res
+		case "lowercase":
+			ll[rule.targetLabel] = strings.ToLower(value)
+		case "labelmap":
+			for _, k := range labelNames(ll) {
+				if k != metricNameLabel && rule.regex.MatchString(k) {
+					ll[rule.regex.ReplaceAllString(k, rule.replacement)] = ll[k]
+				}
+			}
+		case "labeldrop", "labelkeep":
+			for k := range ll {
+				if k != metricNameLabel && rule.regex.MatchString(k) == (rule.action == "labeldrop") {
+					delete(ll, k)
+				}
+			}
+		}
+	}
+
+	name = ll[metricNameLabel]
+	delete(ll, metricNameLabel)
+	if name == "" {
+		return "", nil, false
+	}
+	return name, ll, true
+}
+
+func labelNames(labels map[string]string) []string {
+	var names []string
+	for k := range labels {
+		names = append(names, k)
+	}
+	return names
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRelabelerProcess(t *testing.T) {
+	empty := ""
+	plant := "plant_$1"
+	tests := []struct {
+		name       string
+		rules      []*RelabelConfig
+		metric     string
+		labels     map[string]string
+		wantName   string
+		wantLabels map[string]string
+		wantKeep   bool
+	}{
+		{
+			name:       "no rules",
+			metric:     "speed",
+			labels:     map[string]string{"line": "1"},
+			wantName:   "speed",
+			wantLabels: map[string]string{"line": "1"},
+			wantKeep:   true,
+		},
+		{
+			name:       "rename with replacement",
+			rules:      []*RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "vendor_(.*)", TargetLabel: "__name__", Replacement: &plant}},
+			metric:     "vendor_speed",
+			labels:     map[string]string{},
+			wantName:   "plant_speed",
+			wantLabels: map[string]string{},
+			wantKeep:   true,
+		},
+		{
+			name:       "default replacement",
+			rules:      []*RelabelConfig{{SourceLabels: []string{"line"}, Regex: "line-(.*)", TargetLabel: "line"}},
+			metric:     "speed",
+			labels:     map[string]string{"line": "line-2"},
+			wantName:   "speed",
+			wantLabels: map[string]string{"line": "2"},
+			wantKeep:   true,
+		},
+		{
+			name:       "explicit empty replacement removes the label",
+			rules:      []*RelabelConfig{{SourceLabels: []string{"line"}, TargetLabel: "line", Replacement: &empty}},
+			metric:     "speed",
+			labels:     map[string]string{"line": "1", "site": "a"},
+			wantName:   "speed",
+			wantLabels: map[string]string{"site": "a"},
+			wantKeep:   true,
+		},
+		{
+			name:       "separator",
+			rules:      []*RelabelConfig{{SourceLabels: []string{"site", "line"}, Separator: "/", TargetLabel: "path"}},
+			metric:     "speed",
+			labels:     map[string]string{"line": "1", "site": "a"},
+			wantName:   "speed",
+			wantLabels: map[string]string{"line": "1", "site": "a", "path": "a/1"},
+			wantKeep:   true,
+		},
+		{
+			name:       "lowercase",
+			rules:      []*RelabelConfig{{SourceLabels: []string{"__name__"}, Action: "lowercase", TargetLabel: "__name__"}},
+			metric:     "Spindle_Speed",
+			labels:     map[string]string{},
+			wantName:   "spindle_speed",
+			wantLabels: map[string]string{},
+			wantKeep:   true,
+		},
+		{
+			name:     "keep",
+			rules:    []*RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "opcua_.*", Action: "keep"}},
+			metric:   "speed",
+			labels:   map[string]string{},
+			wantKeep: false,
+		},
+		{
+			name:     "drop",
+			rules:    []*RelabelConfig{{SourceLabels: []string{"line"}, Regex: "test", Action: "drop"}},
+			metric:   "speed",
+			labels:   map[string]string{"line": "test"},
+			wantKeep: false,
+		},
+		{
+			name:       "labelmap",
+			rules:      []*RelabelConfig{{Regex: "opc_(.*)", Action: "labelmap"}},
+			metric:     "speed",
+			labels:     map[string]string{"opc_line": "1"},
+			wantName:   "speed",
+			wantLabels: map[string]string{"opc_line": "1", "line": "1"},
+			wantKeep:   true,
+		},
+		{
+			name:       "labeldrop",
+			rules:      []*RelabelConfig{{Regex: "debug_.*", Action: "labeldrop"}},
+			metric:     "speed",
+			labels:     map[string]string{"debug_id": "x", "line": "1"},
+			wantName:   "speed",
+			wantLabels: map[string]string{"line": "1"},
+			wantKeep:   true,
+		},
+		{
+			name:       "labelkeep",
+			rules:      []*RelabelConfig{{Regex: "line", Action: "labelkeep"}},
+			metric:     "speed",
+			labels:     map[string]string{"debug_id": "x", "line": "1"},
+			wantName:   "speed",
+			wantLabels: map[string]string{"line": "1"},
+			wantKeep:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRelabeler(tt.rules)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			labels := map[string]string{}
+			for k, v := range tt.labels {
+				labels[k] = v
+			}
+			name, got, keep := r.Process(tt.metric, labels)
+			if keep != tt.wantKeep {
+				t.Fatalf("got keep %v, want %v", keep, tt.wantKeep)
+			}
+			if !reflect.DeepEqual(labels, tt.labels) {
+				t.Errorf("labels modified to %v", labels)
+			}
+			if !keep {
+				return
+			}
+			if name != tt.wantName {
+				t.Errorf("got name %s, want %s", name, tt.wantName)
+			}
+			if !reflect.DeepEqual(got, tt.wantLabels) {
+				t.Errorf("got labels %v, want %v", got, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestNewRelabelerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RelabelConfig
+		err  string
+	}{
+		{"replace without target", RelabelConfig{SourceLabels: []string{"a"}}, "missing field 'target_label' for action replace"},
+		{"lowercase without target", RelabelConfig{Action: "lowercase"}, "missing field 'target_label' for action lowercase"},
+		{"labeldrop without regex", RelabelConfig{Action: "labeldrop"}, "missing field 'regex' for action labeldrop"},
+		{"labelkeep without regex", RelabelConfig{Action: "labelkeep"}, "missing field 'regex' for action labelkeep"},
+		{"labelmap without regex", RelabelConfig{Action: "labelmap"}, "missing field 'regex' for action labelmap"},
+		{"unknown action", RelabelConfig{Action: "hashmod"}, "unknown relabel action hashmod"},
+		{"invalid regex", RelabelConfig{Action: "drop", Regex: "("}, "invalid regex"},
+		{"invalid target", RelabelConfig{SourceLabels: []string{"a"}, TargetLabel: "zone-a"}, `invalid target_label "zone-a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			_, err := NewRelabeler([]*RelabelConfig{&rule})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRelabelConfigNotModified(t *testing.T) {
+	content := []byte(`metrics: []
+metric_relabel_configs:
+- source_labels: [line]
+  target_label: line
+  replacement: ""
+- regex: debug_.*
+  action: labeldrop
+`)
+	mm := &MetricsConfig{}
+	if err := mm.Unserialize(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := mm.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"separator", "$1", "action: replace", "(.*)"} {
+		if strings.Contains(string(out), s) {
+			t.Errorf("serialized config contains default %q:\n%s", s, out)
+		}
+	}
+	if !strings.Contains(string(out), `replacement: ""`) {
+		t.Errorf("serialized config lost the empty replacement:\n%s", out)
+	}
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var placeholderRE = regexp.MustCompile(`\{[a-zA-Z_][a-zA-Z0-9_]*\}`)
+
+// Template is a metric whose string fields contain {parameter} placeholders,
+// expanded for every combination of its parameter values. Parameters are
+// added to the labels of the expanded metrics.
+type Template struct {
+	Metric     Metric      `yaml:"metric"`
+	Parameters []Parameter `yaml:"parameters"`
+
+	pos *position
+}
+
+type Parameter struct {
+	Name   string   `yaml:"name"`
+	Values []string `yaml:"values,omitempty"`
+	Range  *Range   `yaml:"range,omitempty"`
+}
+
+type Range struct {
+	From int `yaml:"from"`
+	To   int `yaml:"to"`
+	Step int `yaml:"step,omitempty"`
+}
+
+func (p Parameter) values() ([]string, error) {
+	if p.Range == nil {
+		if len(p.Values) == 0 {
+			return nil, fmt.Errorf("parameter %s has no values", p.Name)
+		}
+		return p.Values, nil
+	}
+	step := p.Range.Step
+	if step == 0 {
+		step = 1
+	}
+	if step < 0 || p.Range.To < p.Range.From {
+		return nil, fmt.Errorf("invalid range for parameter %s", p.Name)
+	}
+	values := append([]string(nil), p.Values...)
+	for i := p.Range.From; i <= p.Range.To; i += step {
+		values = append(values, strconv.Itoa(i))
+	}
+	return values, nil
+}
+
+// errorf reports an error of the template i at field of its metric, or of
+// the template itself when the metric does not have it.
+func (t Template) errorf(i int, field string, format string, args ...interface{}) error {
+	p := t.pos
+	if _, ok := t.Metric.pos.fields[field]; ok || p == nil {
+		p = t.Metric.pos
+	}
+	line, column := p.of(field)
+	return ValidationError{File: p.filename(), Line: line, Column: column, Msg: fmt.Sprintf("invalid template %d: ", i) + fmt.Sprintf(format, args...)}
+}
+
+// expand returns the metrics of the template i, every placeholder of which
+// must be a parameter.
+func (t Template) expand(i int) ([]Metric, error) {
+	combinations := []map[string]string{{}}
+	for _, p := range t.Parameters {
+		if p.Name == "" {
+			return nil, t.errorf(i, "parameters", "missing field 'name' in template parameter")
+		}
+		if _, ok := t.Metric.Labels[p.Name]; ok {
+			return nil, t.errorf(i, "labels", "parameter %s shadows the static label %s", p.Name, p.Name)
+		}
+		if _, ok := t.Metric.LabelNodes[p.Name]; ok {
+			return nil, t.errorf(i, "label_nodes", "parameter %s shadows the label %s read from a node", p.Name, p.Name)
+		}
+		values, err := p.values()
+		if err != nil {
+			return nil, t.errorf(i, "parameters", "%v", err)
+		}
+		var next []map[string]string
+		for _, c := range combinations {
+			for _, v := range values {
+				nc := map[string]string{p.Name: v}
+				for k, cv := range c {
+					nc[k] = cv
+				}
+				next = append(next, nc)
+			}
+		}
+		combinations = next
+	}
+
+	var mm []Metric
+	for _, params := range combinations {
+		m := t.Metric.substitute(params)
+		if field, placeholder := m.placeholder(); placeholder != "" {
+			return nil, t.errorf(i, field, "unknown parameter %s in field '%s'", placeholder, field)
+		}
+		mm = append(mm, m)
+	}
+	return mm, nil
+}
+
+func (m Metric) substitute(params map[string]string) Metric {
+	var pairs []string
+	for k, v := range params {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	r := strings.NewReplacer(pairs...)
+
+	m.Name = r.Replace(m.Name)
+	m.Help = r.Replace(m.Help)
+	m.NodeID = r.Replace(m.NodeID)
+	m.Computed = r.Replace(m.Computed)
+	labels := map[string]string{}
+	for k, v := range m.Labels {
+		labels[k] = r.Replace(v)
+	}
+	for k, v := range params {
+		labels[k] = v
+	}
+	m.Labels = labels
+	if m.LabelNodes != nil {
+		nodes := map[string]string{}
+		for k, v := range m.LabelNodes {
+			nodes[k] = r.Replace(v)
+		}
+		m.LabelNodes = nodes
+	}
+	if m.Method != nil {
+		method := *m.Method
+		method.ObjectID = r.Replace(method.ObjectID)
+		method.MethodID = r.Replace(method.MethodID)
+		method.Inputs = nil
+		for _, a := range m.Method.Inputs {
+			method.Inputs = append(method.Inputs, Argument{Type: a.Type, Value: r.Replace(a.Value)})
+		}
+		m.Method = &method
+	}
+	return m
+}
+
+// placeholder returns the first field expanded by substitute still holding a
+// placeholder, along with the placeholder.
+func (m Metric) placeholder() (string, string) {
+	type field struct {
+		name   string
+		values []string
+	}
+	fields := []field{
+		{"name", []string{m.Name}},
+		{"help", []string{m.Help}},
+		{"nodeid", []string{m.NodeID}},
+		{"computed", []string{m.Computed}},
+		{"labels", sortedValues(m.Labels)},
+		{"label_nodes", sortedValues(m.LabelNodes)},
+	}
+	if m.Method != nil {
+		values := []string{m.Method.ObjectID, m.Method.MethodID}
+		for _, a := range m.Method.Inputs {
+			values = append(values, a.Value)
+		}
+		fields = append(fields, field{"method", values})
+	}
+	for _, f := range fields {
+		for _, v := range f.values {
+			if p := placeholderRE.FindString(v); p != "" {
+				return f.name, p
+			}
+		}
+	}
+	return "", ""
+}
+
+func sortedValues(kv map[string]string) []string {
+	var keys, values []string
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values = append(values, kv[k])
+	}
+	return values
+}
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateExpand(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []Metric
+	}{
+		{
+			name: "values",
+			yaml: `
+templates:
+  - metric:
+      name: temperature
+      help: temperature of line {line}
+      nodeid: ns=2;s=line{line}.temp
+      labels: {site: paris}
+      type: gauge
+    parameters:
+      - name: line
+        values: [a, b]
+`,
+			want: []Metric{
+				{Name: "temperature", Help: "temperature of line a", NodeID: "ns=2;s=linea.temp", Labels: map[string]string{"site": "paris", "line": "a"}, Type: "gauge"},
+				{Name: "temperature", Help: "temperature of line b", NodeID: "ns=2;s=lineb.temp", Labels: map[string]string{"site": "paris", "line": "b"}, Type: "gauge"},
+			},
+		},
+		{
+			name: "range and combinations",
+			yaml: `
+templates:
+  - metric:
+      name: speed
+      help: speed
+      nodeid: ns=2;i={base}{axis}
+      labels: {}
+      type: gauge
+    parameters:
+      - name: base
+        values: ["1"]
+      - name: axis
+        range: {from: 1, to: 5, step: 2}
+`,
+			want: []Metric{
+				{Name: "speed", Help: "speed", NodeID: "ns=2;i=11", Labels: map[string]string{"base": "1", "axis": "1"}, Type: "gauge"},
+				{Name: "speed", Help: "speed", NodeID: "ns=2;i=13", Labels: map[string]string{"base": "1", "axis": "3"}, Type: "gauge"},
+				{Name: "speed", Help: "speed", NodeID: "ns=2;i=15", Labels: map[string]string{"base": "1", "axis": "5"}, Type: "gauge"},
+			},
+		},
+		{
+			name: "method and label nodes",
+			yaml: `
+templates:
+  - metric:
+      name: counter
+      help: counter
+      labels: {}
+      label_nodes: {batch: "ns=2;s={m}.batch"}
+      type: gauge
+      method:
+        objectid: ns=2;s={m}
+        methodid: ns=2;s={m}.get
+        inputs: [{type: string, value: "{m}"}]
+    parameters:
+      - name: m
+        values: [m1]
+`,
+			want: []Metric{{
+				Name: "counter", Help: "counter", Labels: map[string]string{"m": "m1"}, Type: "gauge",
+				LabelNodes: map[string]string{"batch": "ns=2;s=m1.batch"},
+				Method:     &Method{ObjectID: "ns=2;s=m1", MethodID: "ns=2;s=m1.get", Inputs: []Argument{{Type: "string", Value: "m1"}}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm := &MetricsConfig{}
+			if err := mm.Unserialize([]byte(tt.yaml)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := mm.Templates[0].expand(0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for i := range got {
+				got[i].pos = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateExpandErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		err  string
+		line int
+	}{
+		{
+			name: "unknown placeholder",
+			yaml: `
+templates:
+  - metric:
+      name: temperature
+      help: temperature
+      nodeid: ns=2;s=line{lien}.temp
+      labels: {}
+      type: gauge
+    parameters:
+      - name: line
+        values: [a]
+`,
+			err:  "unknown parameter {lien} in field 'nodeid'",
+			line: 6,
+		},
+		{
+			name: "placeholder in label value",
+			yaml: `
+templates:
+  - metric:
+      name: temperature
+      help: temperature
+      nodeid: ns=2;i=1
+      labels: {zone: "{zone}"}
+      type: gauge
+    parameters:
+      - name: line
+        values: [a]
+`,
+			err:  "unknown parameter {zone} in field 'labels'",
+			line: 7,
+		},
+		{
+			name: "shadowed static label",
+			yaml: `
+templates:
+  - metric:
+      name: temperature
+      help: temperature
+      nodeid: ns=2;s={line}
+      labels: {line: main}
+      type: gauge
+    parameters:
+      - name: line
+        values: [a]
+`,
+			err:  "parameter line shadows the static label line",
+			line: 7,
+		},
+		{
+			name: "shadowed label node",
+			yaml: `
+templates:
+  - metric:
+      name: temperature
+      help: temperature
+      nodeid: ns=2;s={line}
+      labels: {}
+      label_nodes: {line: ns=2;s=name}
+      type: gauge
+    parameters:
+      - name: line
+        values: [a]
+`,
+			err:  "parameter line shadows the label line read from a node",
+			line: 8,
+		},
+		{
+			name: "missing parameter name",
+			yaml: `
+templates:
+  - metric:
+      name: temperature
+      help: temperature
+      nodeid: ns=2;i=1
+      labels: {}
+      type: gauge
+    parameters:
+      - values: [a]
+`,
+			err:  "missing field 'name' in template parameter",
+			line: 10,
+		},
+		{
+			name: "invalid range",
+			yaml: `
+templates:
+  - metric:
+      name: temperature
+      help: temperature
+      nodeid: ns=2;i={i}
+      labels: {}
+      type: gauge
+    parameters:
+      - name: i
+        range: {from: 5, to: 1}
+`,
+			err:  "invalid range for parameter i",
+			line: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm := &MetricsConfig{}
+			if err := mm.Unserialize([]byte(tt.yaml)); err != nil {
+				t.Fatal(err)
+			}
+			err := mm.resolve()
+			if err == nil {
+				t.Fatalf("expected error %q", tt.err)
+			}
+			verr, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("got %T, want ValidationError", err)
+			}
+			if !strings.Contains(verr.Msg, tt.err) {
+				t.Errorf("got error %q, want %q", verr.Msg, tt.err)
+			}
+			if verr.Line != tt.line {
+				t.Errorf("got line %d, want %d", verr.Line, tt.line)
+			}
+		})
+	}
+}
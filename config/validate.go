@@ -0,0 +1,423 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/skilld-labs/telemetry-opcua-exporter/expr"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+type ValidationError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e ValidationError) Error() string {
+	var prefix string
+	if e.File != "" {
+		prefix = e.File + ": "
+	}
+	if e.Line == 0 {
+		return prefix + e.Msg
+	}
+	return fmt.Sprintf("%sline %d, column %d: %s", prefix, e.Line, e.Column, e.Msg)
+}
+
+type ValidationErrors []ValidationError
+
+func (ee ValidationErrors) Error() string {
+	var ss []string
+	for _, e := range ee {
+		ss = append(ss, e.Error())
+	}
+	return strings.Join(ss, "\n")
+}
+
+// position locates an entry of the configuration file and its fields.
+type position struct {
+	file         string
+	line, column int
+	fields       map[string][2]int
+}
+
+func (p *position) filename() string {
+	if p == nil {
+		return ""
+	}
+	return p.file
+}
+
+// ref describes where field of p is, relative to the entry at from.
+func (p *position) ref(field string, from *position) string {
+	line, _ := p.of(field)
+	if p.filename() == from.filename() {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("line %d of %s", line, p.filename())
+}
+
+func (p *position) of(field string) (int, int) {
+	if p == nil {
+		return 0, 0
+	}
+	if lc, ok := p.fields[field]; ok {
+		return lc[0], lc[1]
+	}
+	return p.line, p.column
+}
+
+func nodePosition(n *yamlv3.Node) *position {
+	p := &position{line: n.Line, column: n.Column, fields: map[string][2]int{}}
+	if n.Kind == yamlv3.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v := n.Content[i+1]
+			p.fields[n.Content[i].Value] = [2]int{v.Line, v.Column}
+		}
+	}
+	return p
+}
+
+func mappingValue(n *yamlv3.Node, key string) *yamlv3.Node {
+	if n == nil || n.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// locate records the position of the metrics, templates, events and
+// relabeling entries.
+func (mm *MetricsConfig) locate(content []byte) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(content, &doc); err != nil || len(doc.Content) == 0 {
+		return
+	}
+	root := doc.Content[0]
+	if seq := mappingValue(root, "metrics"); seq != nil && seq.Kind == yamlv3.SequenceNode {
+		for i, n := range seq.Content {
+			if i < len(mm.Metrics) {
+				mm.Metrics[i].pos = nodePosition(n)
+			}
+		}
+	}
+	if seq := mappingValue(root, "templates"); seq != nil && seq.Kind == yamlv3.SequenceNode {
+		for i, n := range seq.Content {
+			if i >= len(mm.Templates) {
+				break
+			}
+			mm.Templates[i].pos = nodePosition(n)
+			if m := mappingValue(n, "metric"); m != nil {
+				mm.Templates[i].Metric.pos = nodePosition(m)
+			}
+		}
+	}
+	if seq := mappingValue(root, "events"); seq != nil && seq.Kind == yamlv3.SequenceNode {
+		for i, n := range seq.Content {
+			if i < len(mm.Events) {
+				mm.Events[i].pos = nodePosition(n)
+			}
+		}
+	}
+	if seq := mappingValue(root, "metric_relabel_configs"); seq != nil && seq.Kind == yamlv3.SequenceNode {
+		for i, n := range seq.Content {
+			if i < len(mm.MetricRelabelConfigs) && mm.MetricRelabelConfigs[i] != nil {
+				mm.MetricRelabelConfigs[i].pos = nodePosition(n)
+			}
+		}
+	}
+}
+
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) addf(p *position, field string, format string, args ...interface{}) {
+	line, column := p.of(field)
+	v.errs = append(v.errs, ValidationError{File: p.filename(), Line: line, Column: column, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) nodeID(p *position, field, value string) {
+	if _, err := ua.ParseNodeID(value); err != nil {
+		v.addf(p, field, "invalid %s %q: %v", field, value, err)
+	}
+}
+
+// validate checks every metric, event and relabeling rule and reports all the
+// errors found.
+func (mm MetricsConfig) validate() error {
+	v := &validator{}
+	type family struct {
+		help   string
+		typ    string
+		labels string
+		pos    *position
+		// states is set for the time spent in each state, whose series
+		// are only known at runtime
+		states bool
+	}
+	families := map[string]family{}
+	series := map[string]*position{}
+	nodes := map[string]*position{}
+
+	for i, m := range mm.AllMetrics() {
+		p := m.pos
+		if m.Name == "" {
+			v.addf(p, "name", "missing field 'name' in 'metrics' configuration of metric %d", i)
+		} else if !metricNameRE.MatchString(m.Name) {
+			v.addf(p, "name", "invalid metric name %q", m.Name)
+		}
+		if m.Help == "" {
+			v.addf(p, "help", "missing field 'help' in 'metrics' configuration of metric %d", i)
+		}
+		switch m.Type {
+		case "":
+			v.addf(p, "type", "missing field 'type' in 'metrics' configuration of metric %d", i)
+		case "counter", "gauge", "untyped", "Float", "Double":
+		default:
+			v.addf(p, "type", "invalid type %q for metric %s, expected counter, gauge, untyped, Float or Double", m.Type, m.Name)
+		}
+
+		var labelNames []string
+		for k := range m.Labels {
+			labelNames = append(labelNames, k)
+		}
+		for k, nodeID := range m.LabelNodes {
+			if _, ok := m.Labels[k]; ok {
+				v.addf(p, "label_nodes", "label %s of metric %s is both static and read from a node", k, m.Name)
+				continue
+			}
+			labelNames = append(labelNames, k)
+			v.nodeID(p, "label_nodes", nodeID)
+		}
+		sort.Strings(labelNames)
+		for _, k := range labelNames {
+			if !labelNameRE.MatchString(k) || strings.HasPrefix(k, "__") {
+				v.addf(p, "labels", "invalid label name %q for metric %s", k, m.Name)
+			}
+		}
+		if _, ok := m.LabelNodes["state"]; ok && m.States != nil {
+			v.addf(p, "label_nodes", "label state of metric %s is reserved for the names of its states", m.Name)
+		} else if _, ok := m.Labels["state"]; ok && m.States != nil {
+			v.addf(p, "labels", "label state of metric %s is reserved for the names of its states", m.Name)
+		}
+
+		switch {
+		case m.Method != nil:
+			if m.Method.ObjectID == "" {
+				v.addf(p, "method", "missing field 'method.objectid' in 'metrics' configuration of metric %d", i)
+			} else {
+				v.nodeID(p, "method", m.Method.ObjectID)
+			}
+			if m.Method.MethodID == "" {
+				v.addf(p, "method", "missing field 'method.methodid' in 'metrics' configuration of metric %d", i)
+			} else {
+				v.nodeID(p, "method", m.Method.MethodID)
+			}
+			for _, a := range m.Method.Inputs {
+				if _, err := a.Variant(); err != nil {
+					v.addf(p, "method", "%v for metric %s", err, m.Name)
+				}
+			}
+		case m.Computed != "":
+			if _, err := expr.Parse(m.Computed); err != nil {
+				v.addf(p, "computed", "invalid expression for metric %s: %v", m.Name, err)
+			}
+		case m.NodeID == "":
+			v.addf(p, "nodeid", "missing field 'nodeid' in 'metrics' configuration of metric %d", i)
+		default:
+			v.nodeID(p, "nodeid", m.NodeID)
+			// a node may back one metric of each kind
+			key := m.kind() + "|" + m.NodeID
+			if prev, ok := nodes[key]; ok {
+				v.addf(p, "nodeid", "duplicate nodeid %s for %s metrics, already used at %s", m.NodeID, m.kind(), prev.ref("nodeid", p))
+			} else {
+				nodes[key] = p
+			}
+		}
+		if m.Aggregate != nil && m.Aggregate.Mode != "histogram" && m.Aggregate.Mode != "minmaxavg" {
+			v.addf(p, "aggregate", "field 'aggregate.mode' must be histogram or minmaxavg for metric %s", m.Name)
+		}
+		switch m.Edge {
+		case "", "rising", "falling", "both", "change":
+		default:
+			v.addf(p, "edge", "field 'edge' must be rising, falling, both or change for metric %s", m.Name)
+		}
+
+		if m.Name == "" {
+			continue
+		}
+		// the series are checked as exposed, after relabeling
+		for _, e := range m.exposed() {
+			rm, keep := mm.relabel(e)
+			if !keep {
+				continue
+			}
+			var names []string
+			for k := range rm.Labels {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			// the names from the configuration are checked above
+			if rm.Name != e.Name && !metricNameRE.MatchString(rm.Name) {
+				v.addf(p, "name", "invalid metric name %q for metric %s after relabeling", rm.Name, e.Name)
+				continue
+			}
+			invalid := false
+			for _, k := range names {
+				_, static := e.Labels[k]
+				_, node := e.LabelNodes[k]
+				if !static && !node && (!labelNameRE.MatchString(k) || strings.HasPrefix(k, "__")) {
+					v.addf(p, "labels", "invalid label name %q for metric %s after relabeling", k, e.Name)
+					invalid = true
+				}
+			}
+			if invalid {
+				continue
+			}
+			f := family{help: e.Help, typ: e.Type, labels: strings.Join(names, ","), pos: p, states: m.States != nil && e.Name != m.Name}
+			if prev, ok := families[rm.Name]; ok {
+				at := prev.pos.ref("name", p)
+				switch {
+				case prev.states || f.states:
+					v.addf(p, "name", "metric %s is already defined at %s", rm.Name, at)
+					continue
+				case prev.help != f.help:
+					v.addf(p, "help", "metric %s has a different help than at %s", rm.Name, at)
+				case prev.typ != f.typ:
+					v.addf(p, "type", "metric %s has a different type than at %s", rm.Name, at)
+				case prev.labels != f.labels:
+					v.addf(p, "labels", "metric %s has different label names (%s) than at %s (%s)", rm.Name, f.labels, at, prev.labels)
+				}
+			} else {
+				families[rm.Name] = f
+			}
+			key := seriesKey(rm)
+			if prev, ok := series[key]; ok {
+				v.addf(p, "labels", "metric %s with labels %v is already defined at %s", rm.Name, rm.Labels, prev.ref("name", p))
+			} else {
+				series[key] = p
+			}
+		}
+	}
+
+	for i, e := range mm.Events {
+		if e.Notifier == "" {
+			v.addf(e.pos, "notifier", "missing field 'notifier' in 'events' configuration of event %d", i)
+		} else {
+			v.nodeID(e.pos, "notifier", e.Notifier)
+		}
+		for _, t := range e.Types {
+			v.nodeID(e.pos, "types", t)
+		}
+	}
+
+	for i, rc := range mm.MetricRelabelConfigs {
+		if rc == nil {
+			continue
+		}
+		if _, err := rc.compile(i); err != nil {
+			v.errs = append(v.errs, err.(ValidationError))
+		}
+	}
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	files := map[string]int{}
+	for i, src := range mm.sources {
+		files[src.file] = i
+	}
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if fi, fj := files[v.errs[i].File], files[v.errs[j].File]; fi != fj {
+			return fi < fj
+		}
+		return v.errs[i].Line < v.errs[j].Line
+	})
+	return v.errs
+}
+
+// relabel returns m with the name and label names it is exposed with, the
+// labels read from nodes having an empty value.
+func (mm MetricsConfig) relabel(m Metric) (Metric, bool) {
+	labels := map[string]string{}
+	for k := range m.LabelNodes {
+		labels[k] = ""
+	}
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	name, labels, keep := mm.relabeler.Process(m.Name, labels)
+	m.Name, m.Labels = name, labels
+	return m, keep
+}
+
+// exposed returns the series families m is exposed as, before relabeling,
+// with the help and type they have on the metrics endpoint.
+func (m Metric) exposed() []Metric {
+	if m.States != nil {
+		// the state label holds the name of each state
+		e := m
+		e.Name, e.Help, e.Type = m.Name+"_state_seconds_total", m.Help+" (seconds spent in each state)", "counter"
+		e.Labels = map[string]string{"state": ""}
+		for k, v := range m.Labels {
+			e.Labels[k] = v
+		}
+		m.Type = "gauge"
+		return []Metric{m, e}
+	}
+	if m.Aggregate == nil {
+		return []Metric{m}
+	}
+	if m.Aggregate.Mode == "histogram" {
+		m.Type = "histogram"
+		return []Metric{m}
+	}
+	var ee []Metric
+	for _, s := range []struct{ suffix, help string }{
+		{"_min", " (minimum over the last window)"},
+		{"_max", " (maximum over the last window)"},
+		{"_avg", " (average over the last window)"},
+	} {
+		e := m
+		e.Name, e.Help, e.Type = m.Name+s.suffix, m.Help+s.help, "gauge"
+		ee = append(ee, e)
+	}
+	return ee
+}
+
+// kind tells how the value of the node of m is exposed.
+func (m Metric) kind() string {
+	switch {
+	case m.States != nil:
+		return "states"
+	case m.Edge != "":
+		return "edge"
+	case m.Aggregate != nil:
+		return "aggregate"
+	}
+	return "value"
+}
+
+func seriesKey(m Metric) string {
+	var ll []string
+	for k, v := range m.Labels {
+		ll = append(ll, k+"="+v)
+	}
+	sort.Strings(ll)
+	return m.Name + "{" + strings.Join(ll, ",") + "}"
+}
@@ -0,0 +1,282 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type wantError struct {
+		line, column int
+		msg          string
+	}
+	tests := []struct {
+		name string
+		yaml string
+		want []wantError
+	}{
+		{
+			name: "valid",
+			yaml: `
+metrics:
+  - name: temperature
+    help: temperature
+    nodeid: ns=2;i=1
+    type: gauge
+  - name: temperature_max
+    help: temperature max
+    nodeid: ns=2;i=1
+    type: gauge
+    aggregate: {mode: minmaxavg}
+  - name: ratio
+    help: ratio
+    computed: temperature / 2
+    type: gauge
+  - name: machine
+    help: machine state
+    nodeid: ns=2;i=5
+    type: gauge
+    labels: {line: a}
+    states: {0: idle, 1: running}
+  - name: reset
+    help: reset
+    type: gauge
+    method:
+      objectid: ns=2;i=10
+      methodid: ns=2;i=11
+      inputs:
+        - {type: int32, value: "5"}
+metric_relabel_configs:
+  - source_labels: [__name__]
+    regex: debug_.*
+    action: drop
+`,
+		},
+		{
+			name: "invalid computed expression",
+			yaml: `
+metrics:
+  - name: ratio
+    help: ratio
+    computed: good / (good + bad
+    type: gauge
+`,
+			want: []wantError{{5, 15, `invalid expression for metric ratio: expected ")"`}},
+		},
+		{
+			name: "invalid method arguments",
+			yaml: `
+metrics:
+  - name: reset
+    help: reset
+    type: gauge
+    method:
+      objectid: ns=2;i=10
+      methodid: ns=2;i=11
+      inputs:
+        - {type: int8, value: "5"}
+        - {type: byte, value: "300"}
+`,
+			want: []wantError{
+				{7, 7, "unsupported argument type int8 for metric reset"},
+				{7, 7, `invalid byte argument "300"`},
+			},
+		},
+		{
+			name: "duplicate nodeid of the same kind",
+			yaml: `
+metrics:
+  - name: temperature
+    help: temperature
+    nodeid: ns=2;i=1
+    type: gauge
+  - name: temperature_histogram
+    help: temperature histogram
+    nodeid: ns=2;i=1
+    type: gauge
+    aggregate: {mode: histogram}
+  - name: temperature_avg
+    help: temperature avg
+    nodeid: ns=2;i=1
+    type: gauge
+    aggregate: {mode: minmaxavg}
+  - name: temperature_copy
+    help: temperature copy
+    nodeid: ns=2;i=1
+    type: gauge
+`,
+			want: []wantError{
+				{14, 13, "duplicate nodeid ns=2;i=1 for aggregate metrics, already used at line 9"},
+				{19, 13, "duplicate nodeid ns=2;i=1 for value metrics, already used at line 5"},
+			},
+		},
+		{
+			name: "minmaxavg series colliding with other metrics",
+			yaml: `
+metrics:
+  - name: temperature_max
+    help: temperature (maximum over the last window)
+    nodeid: ns=2;i=1
+    type: gauge
+  - name: temperature
+    help: temperature
+    nodeid: ns=2;i=2
+    type: gauge
+    aggregate: {mode: minmaxavg}
+  - name: temperature_avg
+    help: temperature avg
+    nodeid: ns=2;i=3
+    type: gauge
+`,
+			want: []wantError{
+				{7, 5, "metric temperature_max with labels map[] is already defined at line 3"},
+				{12, 5, "metric temperature_avg with labels map[] is already defined at line 7"},
+				{13, 11, "metric temperature_avg has a different help than at line 7"},
+			},
+		},
+		{
+			name: "histogram colliding with a gauge",
+			yaml: `
+metrics:
+  - name: vibration
+    help: vibration
+    nodeid: ns=2;i=1
+    type: gauge
+    aggregate: {mode: histogram}
+  - name: vibration
+    help: vibration
+    nodeid: ns=2;i=2
+    type: gauge
+`,
+			want: []wantError{
+				{8, 5, "metric vibration with labels map[] is already defined at line 3"},
+				{11, 11, "metric vibration has a different type than at line 3"},
+			},
+		},
+		{
+			name: "states colliding with other metrics",
+			yaml: `
+metrics:
+  - name: machine
+    help: machine state
+    nodeid: ns=2;i=1
+    type: gauge
+    labels: {state: x}
+    states: {0: idle, 1: running}
+  - name: machine_state_seconds_total
+    help: machine state (seconds spent in each state)
+    nodeid: ns=2;i=2
+    type: counter
+    labels: {state: idle}
+  - name: spindle
+    help: spindle state
+    nodeid: ns=2;i=3
+    type: gauge
+    label_nodes: {state: ns=2;i=4}
+    states: {0: stopped}
+`,
+			want: []wantError{
+				{7, 13, "label state of metric machine is reserved for the names of its states"},
+				{9, 11, "metric machine_state_seconds_total is already defined at line 3"},
+				{18, 18, "label state of metric spindle is reserved for the names of its states"},
+			},
+		},
+		{
+			name: "invalid names after relabeling",
+			yaml: `
+metrics:
+  - name: temperature
+    help: temperature
+    nodeid: ns=2;i=1
+    type: gauge
+    labels: {tag_1: x}
+metric_relabel_configs:
+  - action: labelmap
+    regex: tag_(.*)
+  - source_labels: [__name__]
+    target_label: ${1}-copy
+    replacement: x
+  - source_labels: [tag_1]
+    target_label: __name__
+    replacement: 1st
+`,
+			want: []wantError{
+				{3, 11, `invalid metric name "1st" for metric temperature after relabeling`},
+			},
+		},
+		{
+			name: "invalid label names after relabeling",
+			yaml: `
+metrics:
+  - name: temperature
+    help: temperature
+    nodeid: ns=2;i=1
+    type: gauge
+    labels: {tag_1: x}
+metric_relabel_configs:
+  - action: labelmap
+    regex: tag_(.*)
+  - source_labels: [__name__]
+    target_label: ${1}-copy
+    replacement: x
+`,
+			want: []wantError{
+				{7, 13, `invalid label name "1" for metric temperature after relabeling`},
+				{7, 13, `invalid label name "temperature-copy" for metric temperature after relabeling`},
+			},
+		},
+		{
+			name: "invalid relabel configs",
+			yaml: `
+metrics: []
+metric_relabel_configs:
+  - source_labels: [line]
+    regex: "("
+    action: drop
+  - action: hashmod
+  - source_labels: [line]
+  - action: labeldrop
+`,
+			want: []wantError{
+				{5, 12, "invalid metric_relabel_configs 0: invalid regex"},
+				{7, 13, "invalid metric_relabel_configs 1: unknown relabel action hashmod"},
+				{8, 5, "invalid metric_relabel_configs 2: missing field 'target_label' for action replace"},
+				{9, 13, "invalid metric_relabel_configs 3: missing field 'regex' for action labeldrop"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm := &MetricsConfig{}
+			if err := mm.Unserialize([]byte(tt.yaml)); err != nil {
+				t.Fatal(err)
+			}
+			if err := mm.resolve(); err != nil {
+				t.Fatal(err)
+			}
+			err := mm.validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			errs, ok := err.(ValidationErrors)
+			if !ok {
+				t.Fatalf("got %T (%v), want ValidationErrors", err, err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(tt.want), errs)
+			}
+			for i, w := range tt.want {
+				got := errs[i]
+				if got.Line != w.line || got.Column != w.column {
+					t.Errorf("error %d: got line %d, column %d, want line %d, column %d", i, got.Line, got.Column, w.line, w.column)
+				}
+				if !strings.Contains(got.Msg, w.msg) {
+					t.Errorf("error %d: got %q, want %q", i, got.Msg, w.msg)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,507 @@
+// Package expr implements the expressions of computed metrics.
+//
+// An expression is arithmetic/boolean over the values of other metrics, e.g.
+// `good_parts / (good_parts + bad_parts{line="1"})`. Booleans are represented
+// as 1 and 0.
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a parsed expression.
+type Expr interface {
+	Eval(values []Sample) (float64, error)
+}
+
+// Sample is the value of a metric series an expression may refer to.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+type numberExpr float64
+
+type refExpr struct {
+	name   string
+	labels map[string]string
+}
+
+type unaryExpr struct {
+	op string
+	x  Expr
+}
+
+type binaryExpr struct {
+	op   string
+	x, y Expr
+}
+
+type callExpr struct {
+	fn   string
+	args []Expr
+}
+
+func (e numberExpr) Eval([]Sample) (float64, error) {
+	return float64(e), nil
+}
+
+func (e *refExpr) matches(values []Sample) []float64 {
+	var vv []float64
+	for _, s := range values {
+		if s.Name != e.name {
+			continue
+		}
+		match := true
+		for k, v := range e.labels {
+			if s.Labels[k] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			vv = append(vv, s.Value)
+		}
+	}
+	return vv
+}
+
+func (e *refExpr) Eval(values []Sample) (float64, error) {
+	vv := e.matches(values)
+	switch len(vv) {
+	case 0:
+		return 0, fmt.Errorf("no value for %s", e)
+	case 1:
+		return vv[0], nil
+	default:
+		return 0, fmt.Errorf("%d values for %s, use an aggregation or more labels", len(vv), e)
+	}
+}
+
+func (e *refExpr) String() string {
+	var ll []string
+	for k, v := range e.labels {
+		ll = append(ll, fmt.Sprintf("%s=%q", k, v))
+	}
+	if len(ll) == 0 {
+		return e.name
+	}
+	return e.name + "{" + strings.Join(ll, ",") + "}"
+}
+
+func (e *unaryExpr) Eval(values []Sample) (float64, error) {
+	x, err := e.x.Eval(values)
+	if err != nil {
+		return 0, err
+	}
+	if e.op == "!" {
+		return boolValue(x == 0), nil
+	}
+	return -x, nil
+}
+
+func (e *binaryExpr) Eval(values []Sample) (float64, error) {
+	x, err := e.x.Eval(values)
+	if err != nil {
+		return 0, err
+	}
+	// short-circuit boolean operators
+	switch {
+	case e.op == "&&" && x == 0:
+		return 0, nil
+	case e.op == "||" && x != 0:
+		return 1, nil
+	}
+	y, err := e.y.Eval(values)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	case "%":
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return math.Mod(x, y), nil
+	case "==":
+		return boolValue(x == y), nil
+	case "!=":
+		return boolValue(x != y), nil
+	case "<":
+		return boolValue(x < y), nil
+	case "<=":
+		return boolValue(x <= y), nil
+	case ">":
+		return boolValue(x > y), nil
+	case ">=":
+		return boolValue(x >= y), nil
+	case "&&", "||":
+		return boolValue(y != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", e.op)
+}
+
+func (e *callExpr) Eval(values []Sample) (float64, error) {
+	switch e.fn {
+	case "sum", "avg", "count":
+		ref := e.args[0].(*refExpr)
+		vv := ref.matches(values)
+		if e.fn == "count" {
+			return float64(len(vv)), nil
+		}
+		if len(vv) == 0 {
+			return 0, fmt.Errorf("no value for %s", ref)
+		}
+		var sum float64
+		for _, v := range vv {
+			sum += v
+		}
+		if e.fn == "avg" {
+			return sum / float64(len(vv)), nil
+		}
+		return sum, nil
+	}
+
+	var vv []float64
+	for _, a := range e.args {
+		if ref, ok := a.(*refExpr); ok && (e.fn == "min" || e.fn == "max") {
+			matches := ref.matches(values)
+			if len(matches) == 0 {
+				return 0, fmt.Errorf("no value for %s", ref)
+			}
+			vv = append(vv, matches...)
+			continue
+		}
+		v, err := a.Eval(values)
+		if err != nil {
+			return 0, err
+		}
+		vv = append(vv, v)
+	}
+	switch e.fn {
+	case "min", "max":
+		r := vv[0]
+		for _, v := range vv[1:] {
+			if (e.fn == "min" && v < r) || (e.fn == "max" && v > r) {
+				r = v
+			}
+		}
+		return r, nil
+	case "abs":
+		return math.Abs(vv[0]), nil
+	}
+	return 0, fmt.Errorf("unknown function %s", e.fn)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// expression grammar, from lowest to highest precedence:
+//
+//	or      = and { "||" and }
+//	and     = cmp { "&&" cmp }
+//	cmp     = sum [ ("=="|"!="|"<"|"<="|">"|">=") sum ]
+//	sum     = product { ("+"|"-") product }
+//	product = unary { ("*"|"/"|"%") unary }
+//	unary   = ("-"|"!") unary | primary
+//	primary = number | "(" or ")" | ident "(" args ")" | ident [ "{" labels "}" ]
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+// Parse parses an expression.
+func Parse(s string) (Expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(t string) error {
+	if got := p.next(); got != t {
+		if got == "" {
+			return fmt.Errorf("expected %q, got end of expression", t)
+		}
+		return fmt.Errorf("expected %q, got %q", t, got)
+	}
+	return nil
+}
+
+func (p *parser) parseBinary(ops []string, operand func() (Expr, error)) (Expr, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		found := false
+		for _, o := range ops {
+			if op == o {
+				found = true
+			}
+		}
+		if !found {
+			return x, nil
+		}
+		p.next()
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	return p.parseBinary([]string{"||"}, p.parseAnd)
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	return p.parseBinary([]string{"&&"}, p.parseCmp)
+}
+
+// parseCmp accepts a single comparison, `a < b < c` being ambiguous.
+func (p *parser) parseCmp() (Expr, error) {
+	x, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	if !isComparison(op) {
+		return x, nil
+	}
+	p.next()
+	y, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); isComparison(next) {
+		return nil, fmt.Errorf("unexpected %q, comparisons cannot be chained", next)
+	}
+	return &binaryExpr{op: op, x: x, y: y}, nil
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseSum() (Expr, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseProduct)
+}
+
+func (p *parser) parseProduct() (Expr, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if op := p.peek(); op == "-" || op == "!" {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t == "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case unicode.IsDigit(rune(t[0])) || t[0] == '.':
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t)
+		}
+		return numberExpr(f), nil
+	case isIdentStart(rune(t[0])):
+		if p.peek() == "(" {
+			return p.parseCall(t)
+		}
+		return p.parseRef(t)
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
+
+func (p *parser) parseCall(fn string) (Expr, error) {
+	p.next()
+	var args []Expr
+	for p.peek() != ")" {
+		a, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	switch fn {
+	case "sum", "avg", "count":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s expects a single metric", fn)
+		}
+		if _, ok := args[0].(*refExpr); !ok {
+			return nil, fmt.Errorf("%s expects a metric", fn)
+		}
+	case "min", "max":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s expects at least one argument", fn)
+		}
+	case "abs":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s expects a single argument", fn)
+		}
+	default:
+		return nil, fmt.Errorf("unknown function %s", fn)
+	}
+	return &callExpr{fn: fn, args: args}, nil
+}
+
+func (p *parser) parseRef(name string) (Expr, error) {
+	ref := &refExpr{name: name, labels: map[string]string{}}
+	if p.peek() != "{" {
+		return ref, nil
+	}
+	p.next()
+	for p.peek() != "}" {
+		k := p.next()
+		if k == "" || !isIdentStart(rune(k[0])) {
+			return nil, fmt.Errorf("invalid label name %q", k)
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		v := p.next()
+		if len(v) < 2 || v[0] != '"' {
+			return nil, fmt.Errorf("invalid value for label %s", k)
+		}
+		uv, err := strconv.Unquote(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %s: %v", k, err)
+		}
+		ref.labels[k] = uv
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	return ref, p.expect("}")
+}
+
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case isIdentStart(r):
+			j := i + 1
+			for j < len(rs) && (isIdentStart(rs[j]) || unicode.IsDigit(rs[j])) {
+				j++
+			}
+			tokens = append(tokens, string(rs[i:j]))
+			i = j
+		case unicode.IsDigit(r) || r == '.':
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E' ||
+				((rs[j] == '+' || rs[j] == '-') && (rs[j-1] == 'e' || rs[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, string(rs[i:j]))
+			i = j
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, string(rs[i:j+1]))
+			i = j + 1
+		default:
+			if i+1 < len(rs) {
+				switch two := string(rs[i : i+2]); two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					tokens = append(tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!(){},=", r) {
+				return nil, fmt.Errorf("unexpected character %q", r)
+			}
+			tokens = append(tokens, string(r))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r == ':' || unicode.IsLetter(r)
+}
@@ -0,0 +1,131 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 2 / 3", 2},
+		{"7 % 4 * 2", 6},
+		{"-2 * 3", -6},
+		{"- -2", 2},
+		{"1 + 2 == 3", 1},
+		{"2 * 3 > 5", 1},
+		{"1 < 2 && 3 < 2", 0},
+		{"1 < 2 || 3 < 2 && 0", 1},
+		{"(1 || 0) && 0", 0},
+		{"!0 + 1", 2},
+		{"!(1 == 1)", 0},
+		{"1.5e1 + .5", 15.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := e.Eval(nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", "unexpected end of expression"},
+		{"1 +", "unexpected end of expression"},
+		{"(1 + 2", `expected ")"`},
+		{"1 2", `unexpected "2"`},
+		{"a < b < c", "comparisons cannot be chained"},
+		{"a == b != c", "comparisons cannot be chained"},
+		{"1 # 2", "unexpected character"},
+		{`a{line="1}`, "unterminated string"},
+		{"a{line=1}", "invalid value for label line"},
+		{"a{1=\"x\"}", "invalid label name"},
+		{"sum(1)", "sum expects a metric"},
+		{"avg(a, b)", "avg expects a single metric"},
+		{"max()", "max expects at least one argument"},
+		{"abs(1, 2)", "abs expects a single argument"},
+		{"log(a)", "unknown function log"},
+		{"1..2", "invalid number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			if err == nil {
+				t.Fatalf("expected error containing %q", tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEval(t *testing.T) {
+	samples := []Sample{
+		{Name: "good", Labels: map[string]string{"line": "1"}, Value: 90},
+		{Name: "good", Labels: map[string]string{"line": "2"}, Value: 30},
+		{Name: "bad", Labels: map[string]string{"line": "1"}, Value: 10},
+		{Name: "temp", Value: -4},
+	}
+	tests := []struct {
+		expr string
+		want float64
+		err  string
+	}{
+		{expr: `good{line="1"} / (good{line="1"} + bad{line="1"})`, want: 0.9},
+		{expr: "sum(good)", want: 120},
+		{expr: "avg(good)", want: 60},
+		{expr: "count(good)", want: 2},
+		{expr: "count(missing)", want: 0},
+		{expr: "max(good, bad)", want: 90},
+		{expr: "min(good, 50)", want: 30},
+		{expr: "abs(temp)", want: 4},
+		{expr: "temp < 0 && bad > 5", want: 1},
+		{expr: "0 && missing", want: 0},
+		{expr: "1 || missing", want: 1},
+		{expr: "good", err: "2 values for good"},
+		{expr: "missing + 1", err: "no value for missing"},
+		{expr: "sum(missing)", err: "no value for missing"},
+		{expr: "good{line=\"1\"} / (bad{line=\"1\"} - 10)", err: "division by zero"},
+		{expr: "1 % 0", err: "division by zero"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			got, err := e.Eval(samples)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
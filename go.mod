@@ -1,10 +1,25 @@
 module github.com/skilld-labs/telemetry-opcua-exporter
 
-go 1.14
+go 1.17
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gopcua/opcua v0.1.14-0.20201026203904-26ad3a299045
 	github.com/prometheus/client_golang v1.8.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.14.0
+	golang.org/x/crypto v0.10.0
 	gopkg.in/yaml.v2 v2.3.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/procfs v0.2.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	google.golang.org/protobuf v1.23.0 // indirect
 )
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/skilld-labs/telemetry-opcua-exporter/collector"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+// configValid is 1 when the last configuration reload succeeded.
+var configValid int32 = 1
+
+func setConfigValid(ok bool) {
+	if ok {
+		atomic.StoreInt32(&configValid, 1)
+		configReloadSuccess.Set(1)
+		configReloadSeconds.SetToCurrentTime()
+	} else {
+		atomic.StoreInt32(&configValid, 0)
+		configReloadSuccess.Set(0)
+	}
+}
+
+// healthHandler tells the HTTP server is up, without touching the OPC UA server.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK\n"))
+}
+
+// readyHandler tells whether the session with the OPC UA server is
+// established and the last configuration reload succeeded.
+func readyHandler(metricsCollector *collector.Collector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := metricsCollector.Status()
+		switch {
+		case !st.Connected:
+			http.Error(w, fmt.Sprintf("OPC UA session %s", st.Connection), http.StatusServiceUnavailable)
+		case atomic.LoadInt32(&configValid) == 0:
+			http.Error(w, "last configuration reload failed", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("OK\n"))
+		}
+	}
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>OPC UA Exporter</title></head>
+<body>
+<h1>OPC UA Exporter</h1>
+<h2>Target</h2>
+<table>
+<tr><th align="left">Endpoint</th><td>{{.Status.Endpoint.URL}}</td></tr>
+<tr><th align="left">Security</th><td>{{.Status.Endpoint.SecurityPolicy}} {{.Status.Endpoint.SecurityMode}}</td></tr>
+<tr><th align="left">Authentication</th><td>{{.Status.Endpoint.AuthMode}}</td></tr>
+<tr><th align="left">Connection</th><td>{{.Status.Connection}}</td></tr>
+<tr><th align="left">Metrics</th><td>{{.Status.Metrics}}</td></tr>
+<tr><th align="left">Last scrape</th><td>{{if .Status.LastScrape.IsZero}}never{{else}}{{.Status.LastScrape.Format "2006-01-02 15:04:05 MST"}} ({{.Status.LastScrapeDuration}}){{end}}</td></tr>
+<tr><th align="left">Configuration</th><td>{{if .ConfigValid}}valid{{else}}last reload failed{{end}}</td></tr>
+</table>
+{{if .Status.LastScrapeErrors}}
+<h2>Last scrape errors</h2>
+<ul>
+{{range .Status.LastScrapeErrors}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}
+<h2>Links</h2>
+<ul>
+<li><a href="/metrics">Metrics</a></li>
+<li><a href="/config">Configuration</a></li>
+<li><a href="/config/history">Configuration history</a></li>
+<li><a href="/api/v1/metrics">Metrics API</a></li>
+<li><a href="/browse/ui">Browse the address space</a></li>
+<li><a href="/discovery">Discovery</a></li>
+<li><a href="/healthz">Health</a></li>
+<li><a href="/ready">Readiness</a></li>
+</ul>
+<p>Generated at {{.Now.Format "2006-01-02 15:04:05 MST"}}</p>
+</body>
+</html>
+`))
+
+func landingHandler(logger log.Logger, metricsCollector *collector.Collector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		data := struct {
+			Status      collector.Status
+			ConfigValid bool
+			Now         time.Time
+		}{metricsCollector.Status(), atomic.LoadInt32(&configValid) == 1, time.Now()}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := landingTemplate.Execute(w, data); err != nil {
+			logger.Err("error rendering landing page: %v", err)
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -16,10 +21,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
+	"github.com/skilld-labs/telemetry-opcua-exporter/client"
 	"github.com/skilld-labs/telemetry-opcua-exporter/collector"
 	"github.com/skilld-labs/telemetry-opcua-exporter/config"
 	"github.com/skilld-labs/telemetry-opcua-exporter/log"
 	"github.com/skilld-labs/telemetry-opcua-exporter/log/jsonlog"
+	"github.com/skilld-labs/telemetry-opcua-exporter/web"
 )
 
 var (
@@ -45,7 +52,24 @@ var (
 	sc = &SafeConfig{
 		C: &config.Config{},
 	}
-	reloadCh                   chan chan error
+	configReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "opcua_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		},
+	)
+	configReloadSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "opcua_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		},
+	)
+	reloadCh chan chan error
+	// reloadStopped is closed on shutdown, once no reload is applied anymore
+	reloadStopped = make(chan struct{})
+	// configLock serializes the changes of the config file made through HTTP,
+	// from reading the current content to recording the new revision
+	configLock                 sync.Mutex
 	registry                   *prometheus.Registry
 	prometheusGoCollector      = prometheus.NewGoCollector()
 	prometheusProcessCollector = prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{})
@@ -55,6 +79,7 @@ func init() {
 	registry = prometheus.NewRegistry()
 	registry.MustRegister(opcuaDuration, opcuaRequestErrors, version.NewCollector("telemetry_opcua_exporter"), opcuaUnexpectedRequestType)
 	registry.MustRegister(prometheusGoCollector, prometheusProcessCollector)
+	registry.MustRegister(configReloadSuccess, configReloadSeconds)
 	reloadCh = make(chan chan error)
 }
 
@@ -67,8 +92,23 @@ func main() {
 	secMode := flag.String("sec-mode", "auto", "Security Mode: one of None, Sign, SignAndEncrypt")
 	secPolicy := flag.String("sec-policy", "None", "Security Policy URL or one of None, Basic128Rsa15, Basic256, Basic256Sha256")
 	authMode := flag.String("auth-mode", "Anonymous", "Authentication Mode: one of Anonymous, UserName, Certificate")
+	endpointFallbacks := flag.String("endpoint-fallbacks", "", "Comma separated list of policy:mode:auth combinations to try, in order, when the selected one is not offered by the server")
+	rewriteEndpointHost := flag.Bool("rewrite-endpoint-host", true, "Replace the host of the endpoint advertised by the server with the one of -endpoint")
 	username := flag.String("username", "", "Username to use in auth-mode UserName")
 	password := flag.String("password", "", "Password to use in auth-mode UserName")
+	discoveryURL := flag.String("discovery-url", "", "Local Discovery Server URL used to resolve the endpoint of -application-uri")
+	applicationURI := flag.String("application-uri", "", "ApplicationURI of the server to look up on the discovery server")
+	reverseConnect := flag.String("reverse-connect", "", "Address to listen on for OPC UA ReverseHello messages, e.g. :4843")
+	serverURI := flag.String("server-uri", "", "ServerUri of the server expected to reverse connect")
+	backfillDir := flag.String("backfill-dir", "", "Directory where OpenMetrics files recovered from the server history are written after connectivity gaps")
+	backfillMinGap := flag.Duration("backfill-min-gap", time.Minute, "Minimum duration of a connectivity loss with the OPC UA server considered as a gap to backfill")
+	stateFile := flag.String("state-file", "", "Path to the file persisting the counters accumulated by the exporter across restarts")
+	historyDir := flag.String("config-history-dir", "", "Directory where the revisions of the configuration are kept, in memory only if empty")
+	historyLimit := flag.Int("config-history-limit", 50, "Number of configuration revisions to keep, 0 to keep them all")
+	webConfig := flag.String("web-config", "", "Path to the web configuration file enabling TLS and authentication")
+	watchConfigFile := flag.Bool("watch-config", true, "Reload the configuration when its files change")
+	watchDebounce := flag.Duration("watch-debounce", 2*time.Second, "Delay without further change before reloading a modified configuration")
+	shutdownGracePeriod := flag.Duration("shutdown-grace-period", 10*time.Second, "Maximum time to finish the running scrapes and close the OPC UA session on SIGTERM")
 	verbosity := flag.String("verbosity", "", "Log verbosity (debug/info/warn/error/fatal)")
 
 	flag.Parse()
@@ -80,35 +120,123 @@ func main() {
 	logger.SetVerbosity(*verbosity)
 	logger.Info("starting telemetry-opcua-exporter")
 
-	c, err := config.NewConfig(*endpoint, *certPath, *keyPath, *secMode, *secPolicy, *authMode, *username, *password, *configPath)
+	if *discoveryURL != "" && *applicationURI == "" {
+		logger.Err("-application-uri is required when -discovery-url is set")
+		os.Exit(1)
+	}
+	if *reverseConnect != "" && *serverURI == "" {
+		logger.Err("-server-uri is required when -reverse-connect is set")
+		os.Exit(1)
+	}
+	fallbacks, err := config.ParseEndpointSelections(*endpointFallbacks)
+	if err != nil {
+		logger.Err("error parsing endpoint fallbacks: %v", err)
+		os.Exit(1)
+	}
+	c, err := config.NewConfig(&config.ServerConfig{
+		Endpoint:              *endpoint,
+		CertPath:              *certPath,
+		KeyPath:               *keyPath,
+		SecMode:               *secMode,
+		SecPolicy:             *secPolicy,
+		AuthMode:              *authMode,
+		Username:              *username,
+		Password:              *password,
+		EndpointFallbacks:     fallbacks,
+		RewriteEndpointHost:   *rewriteEndpointHost,
+		DiscoveryURL:          *discoveryURL,
+		ApplicationURI:        *applicationURI,
+		ReverseConnectAddress: *reverseConnect,
+		ServerURI:             *serverURI,
+	}, *configPath)
 	if err != nil {
 		logger.Err("error parsing config file :%v", err)
 		os.Exit(1)
 	}
 	sc.SetConfig(c)
-	reloadConfigOnChannel(logger, *configPath)
-	reloadConfigOnSignal(logger)
 
-	metricsCollector, err := collector.NewCollector(&collector.CollectorConfig{Config: sc.GetConfig(), Logger: logger})
+	history, err := config.OpenHistory(*historyDir, *historyLimit)
+	if err != nil {
+		logger.Err("error opening config history: %v", err)
+		os.Exit(1)
+	}
+	// the files of a config directory are not tracked, they are only edited by hand
+	if content, err := ioutil.ReadFile(*configPath); err == nil && checkConfigFile(*configPath) == nil {
+		if _, err := history.Add(content, "startup", 0); err != nil {
+			logger.Err("error recording config revision: %v", err)
+		}
+	}
+
+	metricsCollector, err := collector.NewCollector(&collector.CollectorConfig{Config: sc.GetConfig(), Logger: logger, BackfillDir: *backfillDir, BackfillMinGap: *backfillMinGap, StateFile: *stateFile})
 	if err != nil {
 		logger.Err("error while initializing collector : %v", err)
+		os.Exit(1)
 	}
 
 	if err = registry.Register(*metricsCollector); err != nil {
 		logger.Err("error while registering metrics collector : %v", err)
+		os.Exit(1)
 	}
+	setConfigValid(true)
 
-	http.HandleFunc("/metrics", metricsHandler(logger))
-	http.HandleFunc("/config", configHandler(sc, logger))
+	// the reloads are stopped on shutdown, before the collector is closed
+	stopReloads := []func(){reloadConfigOnChannel(logger, *configPath, metricsCollector), reloadConfigOnSignal(logger)}
+	if *watchConfigFile {
+		stopWatch, err := watchConfig(logger, func() []string {
+			return append([]string{*configPath}, sc.GetMetricsConfig().WatchPaths()...)
+		}, func() bool {
+			fp, err := config.Fingerprint(*configPath)
+			return err != nil || fp != sc.GetMetricsConfig().Fingerprint()
+		}, *watchDebounce)
+		if err != nil {
+			logger.Err("cannot watch configuration: %v", err)
+		} else {
+			stopReloads = append(stopReloads, stopWatch)
+		}
+	}
+
+	webConfigFile, err := web.LoadConfigFile(*webConfig)
+	if err != nil {
+		logger.Err("error loading web config: %v", err)
+		os.Exit(1)
+	}
+	auth := web.NewAuthenticator(webConfigFile, logger)
+	mux := http.NewServeMux()
+	read := func(path string, h http.HandlerFunc) { mux.Handle(path, auth.Protect(web.RoleReader, h)) }
+	admin := func(path string, h http.HandlerFunc) { mux.Handle(path, auth.Protect(web.RoleAdmin, h)) }
 
-	http.HandleFunc("/config/reload", reloadConfigHandler(logger, metricsCollector, *configPath, false))
-	http.HandleFunc("/config/update", reloadConfigHandler(logger, metricsCollector, *configPath, true))
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/ready", readyHandler(metricsCollector))
+	read("/", landingHandler(logger, metricsCollector))
+	read("/metrics", metricsHandler(logger))
+	read("/config", configHandler(sc, logger))
+	read("/discovery", discoveryHandler(*discoveryURL, logger))
+	read("/config/history", historyHandler(history))
+	read("/config/diff", diffHandler(history))
+
+	admin("/config/reload", reloadConfigHandler(logger, *configPath, false, history))
+	admin("/config/update", reloadConfigHandler(logger, *configPath, true, history))
+	admin("/config/rollback", rollbackHandler(logger, *configPath, history))
+	newMetricsAPI(logger, *configPath, history).register(mux, auth)
+
+	admin("/browse", browseHandler(logger, metricsCollector))
+	admin("/browse/ui", browseUIHandler)
+	admin("/read", readHandler(logger, metricsCollector))
+
+	admin("/debug/pprof/", pprof.Index)
+	admin("/debug/pprof/cmdline", pprof.Cmdline)
+	admin("/debug/pprof/profile", pprof.Profile)
+	admin("/debug/pprof/symbol", pprof.Symbol)
+	admin("/debug/pprof/trace", pprof.Trace)
 
 	logger.Info("listening on address: %s", *bindAddress)
-	if err = http.ListenAndServe(*bindAddress, nil); err != nil {
+	srv := &http.Server{Addr: *bindAddress, Handler: mux}
+	stopped := shutdownOnSignal(logger, srv, metricsCollector, stopReloads, *shutdownGracePeriod)
+	if err = web.Serve(srv, webConfigFile, logger); err != http.ErrServerClosed {
 		logger.Err("error starting HTTP server: %v", err)
 		os.Exit(1)
 	}
+	<-stopped
 }
 
 func configHandler(sc *SafeConfig, logger log.Logger) func(w http.ResponseWriter, r *http.Request) {
@@ -123,6 +251,43 @@ func configHandler(sc *SafeConfig, logger log.Logger) func(w http.ResponseWriter
 	}
 }
 
+func discoveryHandler(discoveryURL string, logger log.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if discoveryURL == "" {
+			http.Error(w, "no discovery server configured", http.StatusNotFound)
+			return
+		}
+		servers, err := client.FindServers(discoveryURL)
+		if err != nil {
+			logger.Err("error finding servers on %s: %v", discoveryURL, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		type server struct {
+			ApplicationURI  string   `json:"application_uri"`
+			ApplicationName string   `json:"application_name"`
+			ApplicationType string   `json:"application_type"`
+			ProductURI      string   `json:"product_uri"`
+			DiscoveryURLs   []string `json:"discovery_urls"`
+		}
+		var ss []server
+		for _, s := range servers {
+			srv := server{
+				ApplicationURI:  s.ApplicationURI,
+				ApplicationType: s.ApplicationType.String(),
+				ProductURI:      s.ProductURI,
+				DiscoveryURLs:   s.DiscoveryURLs,
+			}
+			if s.ApplicationName != nil {
+				srv.ApplicationName = s.ApplicationName.Text
+			}
+			ss = append(ss, srv)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ss)
+	}
+}
+
 func metricsHandler(logger log.Logger) func(w http.ResponseWriter, r *http.Request) {
 	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -138,7 +303,7 @@ func metricsHandler(logger log.Logger) func(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-func reloadConfigHandler(logger log.Logger, metricsCollector *collector.Collector, configPath string, updateFromBody bool) func(w http.ResponseWriter, r *http.Request) {
+func reloadConfigHandler(logger log.Logger, configPath string, updateFromBody bool, history *config.History) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "POST":
@@ -149,31 +314,186 @@ func reloadConfigHandler(logger log.Logger, metricsCollector *collector.Collecto
 					http.Error(w, "can't read body", http.StatusBadRequest)
 					return
 				}
+				r.Body.Close()
 				if len(body) != 0 {
-					config.WriteFile(configPath, body)
+					if err := (&config.MetricsConfig{}).Unserialize(body); err != nil {
+						http.Error(w, fmt.Sprintf("invalid config: %s", err), http.StatusBadRequest)
+						return
+					}
+					configLock.Lock()
+					defer configLock.Unlock()
+					if err := updateConfig(logger, configPath, body); err != nil {
+						http.Error(w, fmt.Sprintf("failed to update config: %s", err), updateStatus(err))
+						return
+					}
+					if _, err := history.Add(body, clientAddress(r), 0); err != nil {
+						logger.Err("error recording config revision: %v", err)
+					}
+					return
 				}
-				r.Body.Close()
-				logger.Info("%s is rewriten", configPath)
 			}
 
 			if err := sendReloadChannel(); err != nil {
 				http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+				return
 			}
 
-			registry.Unregister(*metricsCollector)
+		default:
+			http.Error(w, "POST method expected", 400)
+		}
+	}
+}
 
-			metricsCollector.ReloadMetrics(sc.GetConfig().MetricsConfig)
-			err := registry.Register(*metricsCollector)
-			if err != nil {
-				logger.Err("error while registering metrics collector : %v", err)
+// updateConfig replaces the config file by content and reloads it. The
+// previous file is put back when the new content is rejected. configLock must
+// be held.
+func updateConfig(logger log.Logger, configPath string, content []byte) error {
+	if err := checkConfigFile(configPath); err != nil {
+		return err
+	}
+	previous, err := ioutil.ReadFile(configPath)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		logger.Err("error reading %s: %v", configPath, err)
+		return err
+	}
+	if err := config.WriteFile(configPath, content); err != nil {
+		logger.Err("error writing %s: %v", configPath, err)
+		return err
+	}
+	logger.Info("%s is rewriten", configPath)
+
+	if err := sendReloadChannel(); err != nil {
+		// the running config was kept, put back the matching file
+		if existed {
+			if err := config.WriteFile(configPath, previous); err != nil {
+				logger.Err("error restoring %s: %v", configPath, err)
 			}
+		} else if err := os.Remove(configPath); err != nil {
+			logger.Err("error removing %s: %v", configPath, err)
+		}
+		return rejectedError{err}
+	}
+	return nil
+}
 
-		default:
+// rejectedError is returned when a new config could be written but not
+// applied.
+type rejectedError struct {
+	error
+}
+
+// errConfigDir is returned by the changes requested through HTTP when the
+// config is a directory, whose files are edited by hand.
+var errConfigDir = errors.New("the configuration is a directory, edit its files instead")
+
+func checkConfigFile(configPath string) error {
+	if fi, err := os.Stat(configPath); err == nil && fi.IsDir() {
+		return errConfigDir
+	}
+	return nil
+}
+
+// updateStatus is the HTTP status of an updateConfig error.
+func updateStatus(err error) int {
+	if _, ok := err.(rejectedError); ok {
+		return http.StatusUnprocessableEntity
+	}
+	if err == errConfigDir {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func clientAddress(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func historyHandler(history *config.History) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		revisions := history.List()
+		if revisions == nil {
+			revisions = []config.Revision{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(revisions)
+	}
+}
+
+func diffHandler(history *config.History) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		to, err := revisionParam(r, "to", history.Latest())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, err := revisionParam(r, "from", to-1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		diff, err := history.Diff(from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(diff))
+	}
+}
+
+func rollbackHandler(logger log.Logger, configPath string, history *config.History) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
 			http.Error(w, "POST method expected", 400)
+			return
+		}
+		rev, err := revisionParam(r, "rev", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		configLock.Lock()
+		defer configLock.Unlock()
+		content, err := history.Content(rev)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
 		}
+		if err := updateConfig(logger, configPath, content); err != nil {
+			http.Error(w, fmt.Sprintf("failed to rollback config: %s", err), updateStatus(err))
+			return
+		}
+		revision, err := history.Add(content, clientAddress(r), rev)
+		if err != nil {
+			logger.Err("error recording config revision: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("config rolled back to revision %d", rev)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(revision)
 	}
 }
 
+func revisionParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		if def <= 0 {
+			return 0, fmt.Errorf("missing parameter %s", name)
+		}
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid parameter %s: %v", name, err)
+	}
+	return n, nil
+}
+
 type SafeConfig struct {
 	sync.RWMutex
 	C *config.Config
@@ -199,24 +519,83 @@ func (sc *SafeConfig) SetConfig(c *config.Config) {
 	sc.Unlock()
 }
 
-func (sc *SafeConfig) reloadConfig(configPath string) error {
-	c := sc.GetConfig()
+// reloadConfig loads configPath and applies it to the collector. Nothing is
+// changed unless every step succeeded.
+func (sc *SafeConfig) reloadConfig(configPath string, metricsCollector *collector.Collector) error {
+	// load into a copy so that an invalid file keeps the previous config active
+	c := *sc.GetConfig()
 	if err := c.LoadMetricsConfig(configPath); err != nil {
 		return err
 	}
-	sc.SetConfig(c)
+	reload, err := metricsCollector.Prepare(c.MetricsConfig)
+	if err != nil {
+		return err
+	}
+	if err := reload.Commit(); err != nil {
+		return err
+	}
+	sc.SetConfig(&c)
 	return nil
 }
 
+var errShuttingDown = errors.New("shutting down, the config is not reloaded")
+
 func sendReloadChannel() error {
 	rc := make(chan error)
-	reloadCh <- rc
-	return <-rc
+	select {
+	case reloadCh <- rc:
+		return <-rc
+	case <-reloadStopped:
+		return errShuttingDown
+	}
+}
+
+// shutdownOnSignal stops the HTTP server, then the reloads by calling each of
+// stopReloads, and closes the collector on SIGTERM or SIGINT, giving up after
+// gracePeriod. The returned channel is closed once the logger is flushed.
+func shutdownOnSignal(logger log.Logger, srv *http.Server, metricsCollector *collector.Collector, stopReloads []func(), gracePeriod time.Duration) <-chan struct{} {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-term
+		logger.Info("received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Warn("error stopping HTTP server: %v", err)
+			}
+			for _, stop := range stopReloads {
+				stop()
+			}
+			if err := metricsCollector.Close(); err != nil {
+				logger.Warn("error closing OPC UA session: %v", err)
+			}
+		}()
+		select {
+		case <-done:
+			logger.Info("shutdown complete")
+		case <-ctx.Done():
+			logger.Warn("shutdown grace period of %s exceeded", gracePeriod)
+		}
+		if err := logger.Shutdown(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		close(stopped)
+	}()
+	return stopped
 }
 
-func reloadConfigOnSignal(logger log.Logger) {
+// reloadConfigOnSignal reloads the config on SIGHUP until the returned
+// function is called.
+func reloadConfigOnSignal(logger log.Logger) func() {
 	hup := make(chan os.Signal, 1)
 	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
 	go func() {
 		for {
 			select {
@@ -224,24 +603,42 @@ func reloadConfigOnSignal(logger log.Logger) {
 				if err := sendReloadChannel(); err != nil {
 					logger.Err(err.Error())
 				}
+			case <-done:
+				return
 			}
 		}
 	}()
+	return func() {
+		signal.Stop(hup)
+		close(done)
+	}
 }
 
-func reloadConfigOnChannel(logger log.Logger, configPath string) {
+// reloadConfigOnChannel applies the reloads sent on reloadCh until the
+// returned function is called, which waits for the reload in progress.
+func reloadConfigOnChannel(logger log.Logger, configPath string, metricsCollector *collector.Collector) func() {
+	exited := make(chan struct{})
 	go func() {
+		defer close(exited)
 		for {
 			select {
 			case rc := <-reloadCh:
-				if err := sc.reloadConfig(configPath); err != nil {
+				if err := sc.reloadConfig(configPath, metricsCollector); err != nil {
 					logger.Err("error reloading config: %v", err)
+					setConfigValid(false)
 					rc <- err
 				} else {
 					logger.Info("config file was reloaded")
+					setConfigValid(true)
 					rc <- nil
 				}
+			case <-reloadStopped:
+				return
 			}
 		}
 	}()
+	return func() {
+		close(reloadStopped)
+		<-exited
+	}
 }
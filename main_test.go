@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skilld-labs/telemetry-opcua-exporter/config"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Err(string, ...interface{})   {}
+func (nopLogger) Panic(string, ...interface{}) {}
+func (nopLogger) Fatal(string, ...interface{}) {}
+func (nopLogger) SetVerbosity(string)          {}
+func (nopLogger) Shutdown() error              { return nil }
+
+const validConfig = `
+metrics:
+  - name: temperature
+    help: temperature
+    nodeid: ns=2;i=1
+    type: gauge
+`
+
+const invalidConfig = `
+metrics:
+  - name: temperature
+    help: temperature
+    type: gauge
+`
+
+// fakeReloads answers the reloads requested on reloadCh by loading
+// configPath, as the collector would before applying it.
+func fakeReloads(t *testing.T, configPath string) {
+	done, exited := make(chan struct{}), make(chan struct{})
+	// the next test must not be answered by this one
+	t.Cleanup(func() {
+		close(done)
+		<-exited
+	})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case rc := <-reloadCh:
+				rc <- (&config.Config{}).LoadMetricsConfig(configPath)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func newConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "opcua.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestReloadFromBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		status    int
+		content   string
+		revisions int
+	}{
+		{name: "valid config", body: validConfig + "    labels: {line: a}\n", status: http.StatusOK, content: validConfig + "    labels: {line: a}\n", revisions: 1},
+		{name: "rejected config is rolled back", body: invalidConfig, status: http.StatusUnprocessableEntity, content: validConfig},
+		{name: "unparsable config", body: "metrics: [", status: http.StatusBadRequest, content: validConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := newConfigFile(t, validConfig)
+			fakeReloads(t, path)
+			history, err := config.OpenHistory("", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			reloadConfigHandler(nopLogger{}, path, true, history)(w, httptest.NewRequest("POST", "/-/reload", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("got status %d (%s), want %d", w.Code, w.Body, tt.status)
+			}
+			if got := readFile(t, path); got != tt.content {
+				t.Errorf("got config file\n%s\nwant\n%s", got, tt.content)
+			}
+			if got := len(history.List()); got != tt.revisions {
+				t.Errorf("got %d revisions, want %d", got, tt.revisions)
+			}
+		})
+	}
+}
+
+func TestReloadConfigDirectory(t *testing.T) {
+	dir := t.TempDir()
+	history, err := config.OpenHistory("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	reloadConfigHandler(nopLogger{}, dir, true, history)(w, httptest.NewRequest("POST", "/-/reload", strings.NewReader(validConfig)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("got status %d (%s), want %d", w.Code, w.Body, http.StatusConflict)
+	}
+	if ff, _ := ioutil.ReadDir(dir); len(ff) != 0 {
+		t.Errorf("the config directory was written")
+	}
+}
+
+func TestRollback(t *testing.T) {
+	path := newConfigFile(t, validConfig)
+	fakeReloads(t, path)
+	history, err := config.OpenHistory("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{validConfig, invalidConfig} {
+		if _, err := history.Add([]byte(content), "test", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := validConfig + "    labels: {line: b}\n"
+	if err := ioutil.WriteFile(path, []byte(second), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		rev     string
+		status  int
+		content string
+	}{
+		{name: "unknown revision", rev: "9", status: http.StatusNotFound, content: second},
+		{name: "rejected revision", rev: "2", status: http.StatusUnprocessableEntity, content: second},
+		{name: "valid revision", rev: "1", status: http.StatusOK, content: validConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rollbackHandler(nopLogger{}, path, history)(w, httptest.NewRequest("POST", "/-/config/rollback?rev="+tt.rev, nil))
+			if w.Code != tt.status {
+				t.Errorf("got status %d (%s), want %d", w.Code, w.Body, tt.status)
+			}
+			if got := readFile(t, path); got != tt.content {
+				t.Errorf("got config file\n%s\nwant\n%s", got, tt.content)
+			}
+		})
+	}
+	if revs := history.List(); len(revs) != 3 || revs[len(revs)-1].RollbackOf != 1 {
+		t.Errorf("got revisions %+v, want the rollback recorded", revs)
+	}
+}
+
+func TestUpdateConfigNewFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opcua.yaml")
+	fakeReloads(t, path)
+	if err := updateConfig(nopLogger{}, path, []byte(invalidConfig)); updateStatus(err) != http.StatusUnprocessableEntity {
+		t.Fatalf("got error %v, want the config rejected", err)
+	}
+	// there was no previous file to put back
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the rejected config was left in place: %v", err)
+	}
+}
+
+func TestStopReloads(t *testing.T) {
+	stopped := reloadStopped
+	reloadStopped = make(chan struct{})
+	t.Cleanup(func() { reloadStopped = stopped })
+
+	path := newConfigFile(t, validConfig)
+	changes := make(chan struct{}, 10)
+	stopWatch, err := watchConfig(nopLogger{}, func() []string { return []string{path} }, func() bool {
+		changes <- struct{}{}
+		return false
+	}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopLoop := reloadConfigOnChannel(nopLogger{}, path, nil)
+
+	// stopped in the order of the shutdown, before closing the collector
+	stopWatch()
+	stopLoop()
+	if err := ioutil.WriteFile(path, []byte(invalidConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- sendReloadChannel() }()
+	select {
+	case err := <-errs:
+		if err != errShuttingDown {
+			t.Errorf("got %v, want %v", err, errShuttingDown)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a reload requested after the shutdown is blocked")
+	}
+	select {
+	case <-changes:
+		t.Error("a change was handled after the watcher was stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/skilld-labs/telemetry-opcua-exporter/collector"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+func readHandler(logger log.Logger, metricsCollector *collector.Collector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		q, err := query(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(apiError{Error: err.Error()})
+			return
+		}
+		if q.Get("nodeid") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(apiError{Error: "missing parameter nodeid"})
+			return
+		}
+		if _, err := ua.ParseNodeID(q.Get("nodeid")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(apiError{Error: fmt.Sprintf("invalid node id %q: %v", q.Get("nodeid"), err)})
+			return
+		}
+		attribute := ua.AttributeIDValue
+		if a := q.Get("attribute"); a != "" {
+			if attribute, err = collector.ParseAttributeID(a); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(apiError{Error: err.Error()})
+				return
+			}
+		}
+		result, err := metricsCollector.Read(q.Get("nodeid"), attribute)
+		if err != nil {
+			logger.Warn("error reading %s: %v", q.Get("nodeid"), err)
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(apiError{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReadInvalidParameters(t *testing.T) {
+	nodeID := "nodeid=" + url.QueryEscape("ns=2;i=10853")
+	tests := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{name: "missing node id", query: "attribute=Value", err: "missing parameter nodeid"},
+		{name: "invalid node id", query: "nodeid=" + url.QueryEscape("ns=2;i=abc"), err: `invalid node id "ns=2;i=abc"`},
+		{name: "unescaped semicolon", query: "nodeid=ns=2;i=10853", err: "invalid query, escape the ; of node ids as %3B"},
+		{name: "unknown attribute name", query: nodeID + "&attribute=Temperature", err: "unknown attribute Temperature"},
+		{name: "attribute id out of range", query: nodeID + "&attribute=0", err: "unknown attribute 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			// the parameters are checked before the server is read
+			readHandler(nopLogger{}, nil)(w, httptest.NewRequest("GET", "/read?"+tt.query, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if got := apiErrorOf(t, w); !strings.HasPrefix(got, tt.err) {
+				t.Errorf("got error %q, want %q", got, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+// watchConfig reloads the config when one of the paths returned by paths
+// changes, once no change happened for debounce. The parent directories of
+// files are watched rather than the files themselves so that files replaced
+// by a rename (editors, Kubernetes ConfigMap volumes) keep being followed.
+// Changes for which changed reports false, such as the writes of the exporter
+// itself, do not trigger a reload. The returned function stops watching.
+func watchConfig(logger log.Logger, paths func() []string, changed func() bool, debounce time.Duration) (func(), error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]bool{}
+	dirs := map[string]bool{}
+	watched := map[string]bool{}
+	update := func() {
+		files = map[string]bool{}
+		dirs = map[string]bool{}
+		for _, p := range paths() {
+			p, err := filepath.Abs(p)
+			if err != nil {
+				continue
+			}
+			dir := filepath.Dir(p)
+			if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+				dirs[p] = true
+				dir = p
+			} else {
+				files[p] = true
+			}
+			if watched[dir] {
+				continue
+			}
+			if err := w.Add(dir); err != nil {
+				logger.Warn("cannot watch %s: %v", dir, err)
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	relevant := func(name string) bool {
+		name, _ = filepath.Abs(name)
+		if files[name] || dirs[name] || dirs[filepath.Dir(name)] {
+			return true
+		}
+		// ConfigMap volumes swap a "..data" symlink to update their files
+		return strings.HasPrefix(filepath.Base(name), "..") && watched[filepath.Dir(name)]
+	}
+	update()
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		var fire <-chan time.Time
+		for {
+			select {
+			case <-done:
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if e.Op == fsnotify.Chmod || !relevant(e.Name) {
+					continue
+				}
+				logger.Debug("config change detected: %s", e)
+				fire = time.After(debounce)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("config watcher error: %v", err)
+			case <-fire:
+				fire = nil
+				if !changed() {
+					logger.Debug("config files match the loaded config, not reloading")
+					update()
+					continue
+				}
+				logger.Info("config files changed, reloading")
+				if err := sendReloadChannel(); err != nil {
+					logger.Err("automatic reload failed: %v", err)
+				}
+				update()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		w.Close()
+	}, nil
+}
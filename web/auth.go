@@ -0,0 +1,158 @@
+package web
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Role int
+
+const (
+	// RoleReader gives access to the metrics and the configuration.
+	RoleReader Role = iota + 1
+	// RoleAdmin also allows to change the configuration and to profile.
+	RoleAdmin
+)
+
+const realm = "telemetry-opcua-exporter"
+
+// dummyHash is compared to the password of unknown users so that they take as
+// long to reject as known ones, not revealing which users exist.
+const dummyHash = "$2a$10$OSEsh6E7iQwJLubsc7dUQewY8Jh.XCas1TgTpo7J1ISz2vYkwtCjO"
+
+// Authenticator checks the credentials of requests against the users and
+// tokens of the web configuration file. Without users nor tokens every
+// request is allowed.
+type Authenticator struct {
+	logger log.Logger
+	file   *ConfigFile
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+	// tokens maps the SHA-256 of the bearer tokens presented with tokensOf
+	// to their name, empty for rejected tokens
+	tokens   map[[sha256.Size]byte]string
+	tokensOf *Config
+}
+
+// maxTokens bounds the bearer tokens remembered, mostly rejected ones.
+const maxTokens = 1024
+
+func NewAuthenticator(f *ConfigFile, l log.Logger) *Authenticator {
+	return &Authenticator{logger: l, file: f, verified: map[[sha256.Size]byte]bool{}}
+}
+
+// Protect only lets requests with the given role reach h.
+func (a *Authenticator) Protect(role Role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.serve(role, h, w, r)
+	})
+}
+
+// ProtectWrites requires the reader role for GET and HEAD requests and the
+// admin role for the others.
+func (a *Authenticator) ProtectWrites(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := RoleAdmin
+		if r.Method == "GET" || r.Method == "HEAD" {
+			role = RoleReader
+		}
+		a.serve(role, h, w, r)
+	})
+}
+
+func (a *Authenticator) serve(role Role, h http.Handler, w http.ResponseWriter, r *http.Request) {
+	c, err := a.file.get()
+	if err != nil {
+		a.logger.Err("%v", err)
+	}
+	if !c.authEnabled() {
+		h.ServeHTTP(w, r)
+		return
+	}
+	name, ok := a.authenticate(c, r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if role == RoleAdmin && !c.isAdmin(name) {
+		a.logger.Warn("%s is not allowed to %s %s", name, r.Method, r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// authenticate returns the user or token name matching the credentials of r.
+func (a *Authenticator) authenticate(c *Config, r *http.Request) (string, bool) {
+	if user, password, ok := r.BasicAuth(); ok {
+		hash, exists := c.BasicAuthUsers[user]
+		if !exists {
+			bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+			return "", false
+		}
+		return user, a.verify(hash, password)
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	return a.token(c, strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+}
+
+// token returns the name of the bearer token. The salted hashes of the
+// configuration cannot be looked up, so a token is compared to all of them
+// the first time it is presented, then found by its SHA-256 until the
+// configuration changes.
+func (a *Authenticator) token(c *Config, token string) (string, bool) {
+	key := sha256.Sum256([]byte(token))
+	a.mu.Lock()
+	if a.tokensOf != c {
+		a.tokens, a.tokensOf = map[[sha256.Size]byte]string{}, c
+	}
+	name, seen := a.tokens[key]
+	a.mu.Unlock()
+	if seen {
+		return name, name != ""
+	}
+	for n, hash := range c.BearerTokens {
+		if a.verify(hash, token) {
+			name = n
+			break
+		}
+	}
+	a.mu.Lock()
+	if a.tokensOf == c {
+		if len(a.tokens) >= maxTokens {
+			a.tokens = map[[sha256.Size]byte]string{}
+		}
+		a.tokens[key] = name
+	}
+	a.mu.Unlock()
+	return name, name != ""
+}
+
+// verify compares secret to a bcrypt hash, remembering the successful
+// comparisons as bcrypt is purposely slow.
+func (a *Authenticator) verify(hash, secret string) bool {
+	key := sha256.Sum256([]byte(hash + "\x00" + secret))
+	a.mu.Lock()
+	ok := a.verified[key]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	a.verified[key] = true
+	a.mu.Unlock()
+	return true
+}
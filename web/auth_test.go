@@ -0,0 +1,147 @@
+package web
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Err(string, ...interface{})   {}
+func (nopLogger) Panic(string, ...interface{}) {}
+func (nopLogger) Fatal(string, ...interface{}) {}
+func (nopLogger) SetVerbosity(string)          {}
+func (nopLogger) Shutdown() error              { return nil }
+
+func hash(t *testing.T, secret string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func TestAuthenticator(t *testing.T) {
+	c := &Config{
+		BasicAuthUsers: map[string]string{"alice": hash(t, "alice-password"), "bob": hash(t, "bob-password")},
+		BearerTokens:   map[string]string{"ci": hash(t, "ci-token")},
+		AdminUsers:     []string{"alice", "ci"},
+	}
+	withBasic := func(user, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	withHeader := func(v string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", v) }
+	}
+	tests := []struct {
+		name   string
+		config *Config
+		method string
+		role   Role
+		auth   func(*http.Request)
+		want   int
+	}{
+		{name: "no users", config: &Config{}, role: RoleAdmin, want: http.StatusOK},
+		{name: "no credentials", role: RoleReader, want: http.StatusUnauthorized},
+		{name: "reader", role: RoleReader, auth: withBasic("bob", "bob-password"), want: http.StatusOK},
+		{name: "reader as admin", role: RoleAdmin, auth: withBasic("bob", "bob-password"), want: http.StatusForbidden},
+		{name: "admin", role: RoleAdmin, auth: withBasic("alice", "alice-password"), want: http.StatusOK},
+		{name: "wrong password", role: RoleReader, auth: withBasic("alice", "bob-password"), want: http.StatusUnauthorized},
+		{name: "unknown user", role: RoleReader, auth: withBasic("carol", "alice-password"), want: http.StatusUnauthorized},
+		{name: "unknown user with the dummy password", role: RoleReader, auth: withBasic("carol", "telemetry-opcua-exporter"), want: http.StatusUnauthorized},
+		{name: "token", role: RoleAdmin, auth: withHeader("Bearer ci-token"), want: http.StatusOK},
+		{name: "wrong token", role: RoleReader, auth: withHeader("Bearer alice-password"), want: http.StatusUnauthorized},
+		{name: "other scheme", role: RoleReader, auth: withHeader("Token ci-token"), want: http.StatusUnauthorized},
+		{name: "writes need admin", method: "POST", auth: withBasic("bob", "bob-password"), want: http.StatusForbidden},
+		{name: "reads need reader", method: "GET", auth: withBasic("bob", "bob-password"), want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			if config == nil {
+				config = c
+			}
+			a := NewAuthenticator(&ConfigFile{config: config}, nopLogger{})
+			ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h := a.Protect(tt.role, ok)
+			if tt.method != "" {
+				h = a.ProtectWrites(ok)
+			}
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			// the second request goes through the cache of verified secrets
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(method, "/", nil)
+				if tt.auth != nil {
+					tt.auth(r)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != tt.want {
+					t.Fatalf("request %d: got status %d, want %d", i, w.Code, tt.want)
+				}
+				if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("request %d: missing WWW-Authenticate header", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBearerTokenIndex(t *testing.T) {
+	c := &Config{BearerTokens: map[string]string{"ci": hash(t, "ci-token"), "mes": hash(t, "mes-token"), "grafana": hash(t, "grafana-token")}}
+	a := NewAuthenticator(&ConfigFile{config: c}, nopLogger{})
+
+	for i := 0; i < 2; i++ {
+		if name, ok := a.token(c, "mes-token"); !ok || name != "mes" {
+			t.Fatalf("request %d: got %q, %v", i, name, ok)
+		}
+		if _, ok := a.token(c, "wrong-token"); ok {
+			t.Fatalf("request %d: wrong token accepted", i)
+		}
+	}
+	if len(a.tokens) != 2 || a.tokens[sha256.Sum256([]byte("mes-token"))] != "mes" {
+		t.Errorf("got index %v", a.tokens)
+	}
+	// the successful comparisons only, the others are not cached
+	if len(a.verified) != 1 {
+		t.Errorf("got %d verified secrets, want 1", len(a.verified))
+	}
+
+	// a token revoked by a new configuration is rejected
+	revoked := &Config{BearerTokens: map[string]string{"ci": c.BearerTokens["ci"]}}
+	if _, ok := a.token(revoked, "mes-token"); ok {
+		t.Error("revoked token accepted")
+	}
+	if name, ok := a.token(revoked, "ci-token"); !ok || name != "ci" {
+		t.Errorf("got %q, %v", name, ok)
+	}
+
+	for i := 0; i < maxTokens+1; i++ {
+		a.token(revoked, strconv.Itoa(i))
+	}
+	if len(a.tokens) > maxTokens {
+		t.Errorf("got %d tokens remembered, want at most %d", len(a.tokens), maxTokens)
+	}
+}
+
+func TestDummyHash(t *testing.T) {
+	cost, err := bcrypt.Cost([]byte(dummyHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("got cost %d, want %d", cost, bcrypt.DefaultCost)
+	}
+}
@@ -0,0 +1,107 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the content of the web configuration file, modelled after the
+// one of the Prometheus exporter-toolkit.
+type Config struct {
+	TLSConfig *TLSConfig `yaml:"tls_server_config"`
+	// BasicAuthUsers maps user names to the bcrypt hash of their password.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	// BearerTokens maps token names to the bcrypt hash of the token.
+	BearerTokens map[string]string `yaml:"bearer_tokens"`
+	// AdminUsers lists the users and token names granted the admin role,
+	// the others are read-only.
+	AdminUsers []string `yaml:"admin_users"`
+}
+
+func (c *Config) authEnabled() bool {
+	return len(c.BasicAuthUsers) > 0 || len(c.BearerTokens) > 0
+}
+
+func (c *Config) isAdmin(name string) bool {
+	for _, a := range c.AdminUsers {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseConfig(content []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, err
+	}
+	if c.TLSConfig != nil {
+		if err := c.TLSConfig.check(); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range c.AdminUsers {
+		_, user := c.BasicAuthUsers[a]
+		_, token := c.BearerTokens[a]
+		if !user && !token {
+			return nil, fmt.Errorf("admin %q is neither a user nor a token", a)
+		}
+	}
+	return c, nil
+}
+
+// ConfigFile reads the web configuration file again when it was modified.
+type ConfigFile struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	config  *Config
+}
+
+// LoadConfigFile reads the web configuration file at path, an empty path
+// giving an empty configuration.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	f := &ConfigFile{path: path, config: &Config{}}
+	if path == "" {
+		return f, nil
+	}
+	if _, err := f.get(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// get returns the current configuration. A file that became invalid keeps
+// the previous configuration active.
+func (f *ConfigFile) get() (*Config, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.path == "" {
+		return f.config, nil
+	}
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return f.config, err
+	}
+	if fi.ModTime().Equal(f.modTime) {
+		return f.config, nil
+	}
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return f.config, err
+	}
+	// an invalid file is only reported once, until it is modified again
+	f.modTime = fi.ModTime()
+	c, err := parseConfig(content)
+	if err != nil {
+		return f.config, fmt.Errorf("invalid web config %s: %v", f.path, err)
+	}
+	f.config = c
+	return c, nil
+}
@@ -0,0 +1,257 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skilld-labs/telemetry-opcua-exporter/log"
+)
+
+type TLSConfig struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ClientAuth string `yaml:"client_auth_type"`
+	ClientCAs  string `yaml:"client_ca_file"`
+	// ClientAllowedSANs and ClientAllowedCommonNames restrict the client
+	// certificates accepted, any of their values being enough.
+	ClientAllowedSANs        []string `yaml:"client_allowed_sans"`
+	ClientAllowedCommonNames []string `yaml:"client_allowed_common_names"`
+	MinVersion               string   `yaml:"min_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// check validates the fields which do not depend on the files.
+func (c *TLSConfig) check() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("missing cert_file or key_file in tls_server_config")
+	}
+	t, err := c.clientAuth()
+	if err != nil {
+		return err
+	}
+	// the allowed subjects are only checked on verified certificates
+	if (len(c.ClientAllowedSANs) > 0 || len(c.ClientAllowedCommonNames) > 0) && t != tls.VerifyClientCertIfGiven && t != tls.RequireAndVerifyClientCert {
+		return errors.New("client_allowed_sans and client_allowed_common_names require client_auth_type VerifyClientCertIfGiven or RequireAndVerifyClientCert")
+	}
+	if _, err := c.minVersion(); err != nil {
+		return err
+	}
+	_, err = c.cipherSuites()
+	return err
+}
+
+func (c *TLSConfig) clientAuth() (tls.ClientAuthType, error) {
+	if c.ClientAuth == "" {
+		if c.ClientCAs != "" {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	}
+	t, ok := clientAuthTypes[c.ClientAuth]
+	if !ok {
+		return 0, fmt.Errorf("invalid client_auth_type %q", c.ClientAuth)
+	}
+	if c.ClientCAs == "" && (t == tls.VerifyClientCertIfGiven || t == tls.RequireAndVerifyClientCert) {
+		return 0, fmt.Errorf("client_ca_file is required with client_auth_type %s", c.ClientAuth)
+	}
+	return t, nil
+}
+
+func (c *TLSConfig) minVersion() (uint16, error) {
+	if c.MinVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("invalid min_version %q, expected TLS10, TLS11, TLS12 or TLS13", c.MinVersion)
+	}
+	return v, nil
+}
+
+func (c *TLSConfig) cipherSuites() ([]uint16, error) {
+	if len(c.CipherSuites) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[s.Name] = s.ID
+	}
+	var ids []uint16
+	for _, name := range c.CipherSuites {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// verifyClient checks the verified client certificate against the allowed
+// SANs and common names, rejecting connections without one.
+func (c *TLSConfig) verifyClient(cs tls.ConnectionState) error {
+	if len(c.ClientAllowedSANs) == 0 && len(c.ClientAllowedCommonNames) == 0 {
+		return nil
+	}
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return errors.New("a verified client certificate is required")
+	}
+	cert := cs.VerifiedChains[0][0]
+	names := []string{}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, allowed := range c.ClientAllowedSANs {
+		for _, n := range names {
+			if n == allowed {
+				return nil
+			}
+		}
+	}
+	for _, allowed := range c.ClientAllowedCommonNames {
+		if cert.Subject.CommonName == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate %q is not allowed", cert.Subject)
+}
+
+// tlsLoader builds the TLS configuration of each connection from the current
+// web configuration, loading the certificates again when their files change.
+type tlsLoader struct {
+	sync.Mutex
+	file   *ConfigFile
+	logger log.Logger
+
+	source  *TLSConfig
+	modTime [3]time.Time
+	config  *tls.Config
+}
+
+func (l *tlsLoader) get() (*tls.Config, error) {
+	c, err := l.file.get()
+	if err != nil {
+		l.logger.Err("%v", err)
+	}
+	if c.TLSConfig == nil {
+		return nil, errors.New("no tls_server_config in web config")
+	}
+	l.Lock()
+	defer l.Unlock()
+	var modTime [3]time.Time
+	for i, path := range []string{c.TLSConfig.CertFile, c.TLSConfig.KeyFile, c.TLSConfig.ClientCAs} {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			modTime[i] = fi.ModTime()
+		}
+	}
+	if l.config != nil && l.source == c.TLSConfig && l.modTime == modTime {
+		return l.config, nil
+	}
+	config, err := build(c.TLSConfig)
+	if err != nil {
+		if l.config != nil {
+			// keep serving with the previous certificates until the files change again
+			l.logger.Err("error reloading TLS configuration: %v", err)
+			l.source, l.modTime = c.TLSConfig, modTime
+			return l.config, nil
+		}
+		return nil, err
+	}
+	if l.config != nil {
+		l.logger.Info("TLS configuration reloaded")
+	}
+	l.source, l.modTime, l.config = c.TLSConfig, modTime, config
+	return config, nil
+}
+
+func build(c *TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates:     []tls.Certificate{cert},
+		VerifyConnection: c.verifyClient,
+		// the config returned by GetConfigForClient replaces the one of the
+		// server, which http.Server sets up for HTTP/2
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if config.ClientAuth, err = c.clientAuth(); err != nil {
+		return nil, err
+	}
+	if config.MinVersion, err = c.minVersion(); err != nil {
+		return nil, err
+	}
+	if config.CipherSuites, err = c.cipherSuites(); err != nil {
+		return nil, err
+	}
+	if c.ClientCAs != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.ClientCAs)
+		}
+	}
+	return config, nil
+}
+
+// Serve runs srv, over TLS when the web configuration has a
+// tls_server_config.
+func Serve(srv *http.Server, f *ConfigFile, logger log.Logger) error {
+	c, _ := f.get()
+	if c.TLSConfig == nil {
+		return srv.ListenAndServe()
+	}
+	l := &tlsLoader{file: f, logger: logger}
+	if _, err := l.get(); err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.get()
+		},
+		// only used to satisfy ListenAndServeTLS, GetConfigForClient has precedence
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c, err := l.get()
+			if err != nil {
+				return nil, err
+			}
+			return &c.Certificates[0], nil
+		},
+	}
+	logger.Info("serving over TLS")
+	return srv.ListenAndServeTLS("", "")
+}
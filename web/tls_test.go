@@ -0,0 +1,244 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert returns a certificate for cn and dnsNames, signed by parent or
+// self-signed when parent is nil.
+func newTestCert(t *testing.T, cn string, dnsNames []string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSClientVerification(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "clients CA", nil, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCA := newTestCert(t, "server CA", nil, nil)
+	certFile, keyFile := newTestCert(t, "exporter", []string{"exporter"}, serverCA).write(t, dir, "server")
+
+	prometheus := newTestCert(t, "prometheus", []string{"prometheus.plant.local"}, ca)
+	other := newTestCert(t, "other", []string{"other.plant.local"}, ca)
+	// signed by an unknown CA but claiming an allowed subject
+	forged := newTestCert(t, "prometheus", []string{"prometheus.plant.local"}, newTestCert(t, "forger", nil, nil))
+
+	tests := []struct {
+		name       string
+		clientAuth string
+		sans       []string
+		cns        []string
+		client     *testCert
+		err        string
+	}{
+		{name: "no restriction", client: other},
+		{name: "allowed SAN", sans: []string{"prometheus.plant.local"}, client: prometheus},
+		{name: "allowed common name", cns: []string{"prometheus"}, client: prometheus},
+		{name: "subject not allowed", sans: []string{"prometheus.plant.local"}, cns: []string{"prometheus"}, client: other, err: "is not allowed"},
+		{name: "unknown CA", sans: []string{"prometheus.plant.local"}, client: forged, err: "certificate"},
+		{name: "no certificate", clientAuth: "VerifyClientCertIfGiven", cns: []string{"prometheus"}, err: "a verified client certificate is required"},
+		{name: "no certificate without restriction", clientAuth: "VerifyClientCertIfGiven"},
+		{name: "given certificate checked", clientAuth: "VerifyClientCertIfGiven", cns: []string{"prometheus"}, client: other, err: "is not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &TLSConfig{
+				CertFile:                 certFile,
+				KeyFile:                  keyFile,
+				ClientCAs:                caFile,
+				ClientAuth:               tt.clientAuth,
+				ClientAllowedSANs:        tt.sans,
+				ClientAllowedCommonNames: tt.cns,
+			}
+			if err := c.check(); err != nil {
+				t.Fatal(err)
+			}
+			serverConfig, err := build(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(serverCA.cert)
+			clientConfig := &tls.Config{RootCAs: roots, ServerName: "exporter"}
+			if tt.client != nil {
+				clientConfig.Certificates = []tls.Certificate{tt.client.tlsCertificate()}
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			done := make(chan error, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					done <- err
+					return
+				}
+				defer conn.Close()
+				done <- tls.Server(conn, serverConfig).Handshake()
+			}()
+			client, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+			if err == nil {
+				client.Close()
+			}
+			err = <-done
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		c    TLSConfig
+		err  string
+	}{
+		{name: "minimal", c: TLSConfig{CertFile: "a", KeyFile: "b"}},
+		{name: "missing key", c: TLSConfig{CertFile: "a"}, err: "missing cert_file or key_file"},
+		{name: "unknown client auth", c: TLSConfig{CertFile: "a", KeyFile: "b", ClientAuth: "Always"}, err: "invalid client_auth_type"},
+		{name: "verification without CA", c: TLSConfig{CertFile: "a", KeyFile: "b", ClientAuth: "RequireAndVerifyClientCert"}, err: "client_ca_file is required"},
+		{name: "subjects with default client auth", c: TLSConfig{CertFile: "a", KeyFile: "b", ClientCAs: "ca", ClientAllowedSANs: []string{"x"}}},
+		{name: "subjects if given", c: TLSConfig{CertFile: "a", KeyFile: "b", ClientCAs: "ca", ClientAuth: "VerifyClientCertIfGiven", ClientAllowedCommonNames: []string{"x"}}},
+		{name: "subjects without client certificates", c: TLSConfig{CertFile: "a", KeyFile: "b", ClientAllowedSANs: []string{"x"}}, err: "require client_auth_type"},
+		{name: "subjects of unverified certificates", c: TLSConfig{CertFile: "a", KeyFile: "b", ClientAuth: "RequireAnyClientCert", ClientAllowedCommonNames: []string{"x"}}, err: "require client_auth_type"},
+		{name: "subjects of requested certificates", c: TLSConfig{CertFile: "a", KeyFile: "b", ClientAuth: "RequestClientCert", ClientAllowedSANs: []string{"x"}}, err: "require client_auth_type"},
+		{name: "unknown version", c: TLSConfig{CertFile: "a", KeyFile: "b", MinVersion: "SSL3"}, err: "invalid min_version"},
+		{name: "unknown cipher suite", c: TLSConfig{CertFile: "a", KeyFile: "b", CipherSuites: []string{"NULL"}}, err: "unknown cipher suite"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.check()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestServeHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "server CA", nil, nil)
+	certFile, keyFile := newTestCert(t, "exporter", []string{"exporter"}, ca).write(t, dir, "server")
+	webConfig := filepath.Join(dir, "web.yml")
+	content := "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n"
+	if err := ioutil.WriteFile(webConfig, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := LoadConfigFile(webConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})}
+	go Serve(srv, f, nopLogger{})
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "exporter"},
+		ForceAttemptHTTP2: true,
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("https://" + addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Proto != "HTTP/2.0" {
+		t.Errorf("got protocol %s, want HTTP/2.0", resp.Proto)
+	}
+}